@@ -4,12 +4,11 @@
 package main
 
 import (
-	"bufio"
+	"flag"
 	"fmt"
-	"log"
-	"math"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -21,8 +20,46 @@ var clients = make(map[string]*ClientConn, 64)
 var ident Ident
 var waitClients []*ClientConn
 
+// timeoutChan receives expectations whose deadlines have passed.
+var timeoutChan = make(chan *Expectation, 16)
+
+// wakeChan receives a value when a client finishes registration or a
+// rate-limiting delay ends.
+var wakeChan = make(chan struct{}, 1)
+
+// closedChan is a closed channel, so receiving from it never blocks.
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// blocked is true if the current script line asked to be retried, so
+// the script should not run again until some event occurs.
+var blocked bool
+
+// lineno is the line number of the script line being executed.
+var lineno int
+
+// linefile names the included file that holds the script line being
+// executed, or is empty for the main script.
+var linefile string
+
+// waitFile, waitLine and waitStart record the script location and
+// start time of the current WAIT, if `waitClients` is not empty.
+var waitFile string
+var waitLine int
+var waitStart time.Time
+
+var reportDir = flag.String("report", "/var/log/boss",
+	"Directory to write junit.xml and summary.json into")
+var libDir = flag.String("lib", "/etc/boss/lib",
+	"Directory to read INCLUDE files from")
+var tlsDir = flag.String("tls", "/etc/boss/tls",
+	"Directory with the testnet CA (ca.pem) and client certificates")
+
 func clientUnknown(name string) {
-	fmt.Printf("ERROR BADNAME %s :Unknown client\n", name)
+	report.Errorf(lineno, "BADNAME %s :Unknown client", name)
 }
 
 // doSendText sends a line from a client to its server.
@@ -30,6 +67,13 @@ func clientUnknown(name string) {
 // The optional '!' prefix suppresses the usual rate limiting logic.
 // Returns true if the send should be retried later.
 func doSendText(name string, text string) bool {
+	// Should we use the default rate-limiting?
+	rateLimit := true
+	if name[0] == '!' {
+		rateLimit = false
+		name = name[1:]
+	}
+
 	// Do we know the client?
 	client, ok := clients[name]
 	if !ok {
@@ -37,39 +81,45 @@ func doSendText(name string, text string) bool {
 		return false
 	}
 
-	// Is this client waiting on text?
-	if len(client.Expect) > 0 {
-		waitClients = append(waitClients, client)
-		return true
+	// Did the client fail to register?
+	if err := client.RunErr(); err != nil {
+		report.Errorf(lineno, "COMMAND SEND :%s not registered: %v", name, err)
+		return false
 	}
 
-	// Should we use the default rate-limiting?
-	rateLimit := true
-	if name[0] == '!' {
-		rateLimit = false
-		name = name[1:]
+	// Is this client waiting on text, or still registering?
+	if len(client.Expect) > 0 || !client.Registered() {
+		return true
 	}
 
 	// Expand the text to send, apply rate limiting, then send..
-	text = client.Expand(text)
+	text, err := client.Expand(text, ExpandText)
+	if err != nil {
+		report.Errorf(lineno, "COMMAND SEND :%v", err)
+		return false
+	}
 	if rateLimit {
-		client.RateLimit(text)
+		if delay := client.RateLimit(text); delay > 0 {
+			wakeAfter(delay)
+			return true
+		}
 	}
 	client.Send(text)
 	return false
 }
 
-// addExpect adds an expected line for the specified client.
-// Syntax: `EXPECT <name>[@<timeout>][!] :<regexp>`
-// The timeout defaults to 10 seconds.
-// The optional `!` after a timeout specifies that a timeout is fatal
+// newExpectation creates an expectation for a client.
+// `name` has the form `[!]<name>[@<timeout>]`.
+// The timeout is a Go duration (or a number of seconds), and defaults
+// to 10 seconds.
+// The optional `!` before the name specifies that a timeout is fatal
 // for the entire script.
-// Named patterns in the regexp are captured in the client's varliables.
-func addExpect(name, pattern string) {
-	exp := Expectation{Deadline: time.Now()}
+// Returns nil (after reporting an error) if `name` is not valid.
+func newExpectation(name string) *Expectation {
+	exp := &Expectation{File: linefile, Line: lineno, Start: time.Now()}
 
 	// Is it fatal?
-	if name[0] == '!' {
+	if name != "" && name[0] == '!' {
 		exp.Fatal = true
 		name = name[1:]
 	}
@@ -80,36 +130,180 @@ func addExpect(name, pattern string) {
 		timeout = name[idx+1:]
 		name = name[:idx]
 	}
-	sec, err := strconv.ParseFloat(timeout, 64)
+	d, err := ParseTimeout(timeout)
 	if err != nil {
-		fmt.Printf("ERROR COMMAND EXPECT :invalid duration %s\n", timeout)
-		return
+		report.Errorf(lineno, "COMMAND EXPECT :invalid duration %s", timeout)
+		return nil
+	}
+	exp.Deadline = exp.Start.Add(d)
+
+	// Look up the client.
+	client, ok := clients[name]
+	if !ok {
+		clientUnknown(name)
+		return nil
 	}
-	exp.Deadline.Add(time.Duration(math.Round(1e9 * sec)))
+	exp.Client = client
+
+	return exp
+}
 
-	// Look up the client so we can expand "pattern".
-	if client, ok := clients[name]; ok {
+// addMatch adds a pattern to `exp`.
+// `count` is how many lines must match, and may be empty to mean one.
+// Returns false (after reporting an error) if an argument is invalid.
+func addMatch(exp *Expectation, count, pattern string) bool {
+	n := 1
+	if count != "" {
 		var err error
-		pattern = client.Expand(pattern)
-		exp.Pattern, err = regexp.Compile(pattern)
-		if err != nil {
-			fmt.Printf("ERROR COMMAND EXPECT :invalid pattern: %v\n", err)
-			return
+		if n, err = strconv.Atoi(count); err != nil || n < 1 {
+			report.Errorf(lineno, "COMMAND EXPECT :invalid count %s", count)
+			return false
+		}
+	}
+
+	// Expand "pattern" for the client and compile it.
+	pattern, err := exp.Client.Expand(pattern, ExpandRegexp)
+	if err != nil {
+		report.Errorf(lineno, "COMMAND EXPECT :%v", err)
+		return false
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		report.Errorf(lineno, "COMMAND EXPECT :invalid pattern: %v", err)
+		return false
+	}
+
+	exp.Matches = append(exp.Matches, &Match{Pattern: re, Count: n})
+	return true
+}
+
+// armExpectation starts the timer for `exp` and queues it for its client.
+func armExpectation(exp *Expectation) {
+	exp.Text = exp.Remaining()
+	exp.timer = time.AfterFunc(time.Until(exp.Deadline), func() { timeoutChan <- exp })
+	if exp.Negate {
+		exp.Client.Reject = append(exp.Client.Reject, exp)
+	} else {
+		exp.Client.Expect = append(exp.Client.Expect, exp)
+	}
+}
+
+// pendingExpect is the `EXPECT ALL` or `EXPECT ANY` expectation whose
+// MATCH lines are being read, or nil.
+var pendingExpect *Expectation
+
+// doExpect adds an expectation for the specified client.
+// Syntax: `EXPECT [!]<name>[@<timeout>] [<count>] :<regexp>`
+// or `EXPECT ALL|ANY [!]<name>[@<timeout>]` followed by one or more
+// `MATCH [<count>] :<regexp>` lines and then `END`.
+// See newExpectation() for the meaning of `!` and `<timeout>`.
+// Named patterns in the regexp are captured in the client's varliables.
+// Variable values are quoted when expanded into the regexp, unless the
+// variable is written as `${=name}`.
+func doExpect(args []string) {
+	// Is this the start of a group?
+	if len(args) == 2 && (args[0] == "ALL" || args[0] == "ANY") {
+		if exp := newExpectation(args[1]); exp != nil {
+			exp.Any = args[0] == "ANY"
+			pendingExpect = exp
 		}
-		client.Expect = append(client.Expect, exp)
+		return
+	}
+
+	// Otherwise it is a single pattern, perhaps with a count.
+	var name, count, pattern string
+	switch len(args) {
+	case 2:
+		name, pattern = args[0], args[1]
+	case 3:
+		name, count, pattern = args[0], args[1], args[2]
+	default:
+		report.Errorf(lineno, "COMMAND EXPECT :wrong number of arguments")
+		return
+	}
+	if exp := newExpectation(name); exp != nil && addMatch(exp, count, pattern) {
+		armExpectation(exp)
+	}
+}
+
+// doExpectNot adds a negative expectation for the specified client.
+// Syntax: `EXPECT-NOT [!]<name>[@<window>] :<regexp>`
+// The expectation fails if the client sees a line matching `<regexp>`
+// before `<window>` has elapsed.
+// See newExpectation() for the meaning of `!` and `<window>`.
+func doExpectNot(args []string) {
+	if len(args) != 2 {
+		report.Errorf(lineno, "COMMAND EXPECT-NOT :wrong number of arguments")
+		return
+	}
+	if exp := newExpectation(args[0]); exp != nil && addMatch(exp, "", args[1]) {
+		exp.Negate = true
+		armExpectation(exp)
+	}
+}
+
+// doMatch adds a pattern to the pending `EXPECT ALL` or `EXPECT ANY`.
+// Syntax: `MATCH [<count>] :<regexp>`
+func doMatch(args []string) {
+	switch len(args) {
+	case 1:
+		addMatch(pendingExpect, "", args[0])
+	case 2:
+		addMatch(pendingExpect, args[0], args[1])
+	default:
+		report.Errorf(lineno, "COMMAND MATCH :wrong number of arguments")
+	}
+}
+
+// doEnd finishes the pending `EXPECT ALL` or `EXPECT ANY`.
+// Syntax: `END`
+func doEnd() {
+	if len(pendingExpect.Matches) == 0 {
+		report.Errorf(lineno, "COMMAND EXPECT :line %d has no MATCH lines",
+			pendingExpect.Line)
 	} else {
-		clientUnknown(name)
+		armExpectation(pendingExpect)
 	}
+	pendingExpect = nil
+}
+
+// expireExpectation handles an expectation whose deadline has passed.
+// A non-fatal expectation is dropped with a warning, and a negative
+// expectation passes.
+// Returns false if the expectation was fatal, so the script should stop.
+func expireExpectation(exp *Expectation) bool {
+	// Was it resolved before the timer fired?
+	if !exp.Client.RemoveExpect(exp) {
+		return true
+	}
+
+	if exp.Negate {
+		report.Add(exp.Result(Absent, ""))
+		return true
+	}
+
+	if !exp.Fatal {
+		fmt.Printf("WARNING EXPECT %s :%s timed out waiting for %s\n",
+			exp.Client.Name, exp.Where(), exp.Remaining())
+		report.Add(exp.Result(TimedOut, "timed out"))
+		return true
+	}
+
+	fmt.Printf("ERROR EXPECT %s :%s timed out waiting for %s\n",
+		exp.Client.Name, exp.Where(), exp.Remaining())
+	report.Add(exp.Result(Fatal, "timed out"))
+	return false
 }
 
 // doWait records that we want to wait for the named clients.
 // Syntax: `WAIT [<name ...>]`
-// Returns true if the WAIT should be retried later.
-func doWait(names []string) bool {
+// The script does not continue until `waitClients` is empty.
+func doWait(names []string) {
+	waitFile, waitLine, waitStart = linefile, lineno, time.Now()
 	if len(names) == 0 {
 		// Default to waiting for all clients with expectations.
 		for _, client := range clients {
-			if len(client.Expect) > 0 {
+			if client.Pending() {
 				waitClients = append(waitClients, client)
 			}
 		}
@@ -124,7 +318,8 @@ func doWait(names []string) bool {
 		}
 	}
 
-	return len(waitClients) > 0
+	// Record the result now if there is nothing to wait for.
+	checkWaitClients()
 }
 
 // checkWaitClients processes expectations for some set of clients.
@@ -133,7 +328,7 @@ func doWait(names []string) bool {
 func checkWaitClients() bool {
 	jj := 0
 	for ii := 0; ii < len(waitClients); ii++ {
-		if len(waitClients[ii].Expect) > 0 {
+		if waitClients[ii].Pending() {
 			waitClients[jj] = waitClients[ii]
 			jj++
 		}
@@ -142,28 +337,154 @@ func checkWaitClients() bool {
 		waitClients[ii] = nil
 	}
 	waitClients = waitClients[:jj]
-	return jj == 0
+	if jj > 0 {
+		return false
+	}
+
+	report.Add(Result{
+		File:     waitFile,
+		Line:     waitLine,
+		Command:  "WAIT",
+		Outcome:  Matched,
+		Duration: time.Since(waitStart),
+	})
+	return true
+}
+
+// finishReport records results for any checks that are still pending
+// when the script stops.
+func finishReport() {
+	now := time.Now()
+	if pendingExpect != nil {
+		report.ErrorAt(pendingExpect.File, pendingExpect.Line, "COMMAND EXPECT :no END before end of script")
+	}
+	for _, client := range clients {
+		for _, exp := range client.Expect {
+			exp.timer.Stop()
+			outcome := TimedOut
+			if exp.Fatal {
+				outcome = Fatal
+			}
+			report.Add(exp.Result(outcome, "script ended before a match"))
+		}
+		for _, exp := range client.Reject {
+			exp.timer.Stop()
+			report.Add(exp.Result(Absent, "script ended during the window"))
+		}
+	}
+	if len(waitClients) > 0 {
+		report.Add(Result{
+			File:     waitFile,
+			Line:     waitLine,
+			Command:  "WAIT",
+			Outcome:  TimedOut,
+			Duration: now.Sub(waitStart),
+			Message:  "script ended while waiting",
+		})
+	}
+}
+
+// parseClientOptions parses the optional arguments of a CLIENT command:
+// a username and/or `<key>=<value>` options.
+func parseClientOptions(args []string) (options ClientOptions, err error) {
+	for _, arg := range args {
+		key, value, found := strings.Cut(arg, "=")
+		if !found {
+			if options.Username != "" {
+				return options, fmt.Errorf("unexpected argument %s", arg)
+			}
+			options.Username = arg
+			continue
+		}
+
+		switch key {
+		case "caps":
+			options.Caps = []string{}
+			if value != "" {
+				options.Caps = strings.Split(value, ",")
+			}
+		case "sasl":
+			options.SASL = strings.ToUpper(value)
+		case "account":
+			options.Account = value
+		case "password":
+			options.Password = value
+		case "cert":
+			options.Cert = value
+			if !strings.ContainsRune(value, '/') {
+				options.Cert = filepath.Join(*tlsDir, value+".pem")
+			}
+		case "family":
+			if value != "4" && value != "6" {
+				return options, fmt.Errorf("invalid address family %s", value)
+			}
+			options.Network = "tcp" + value
+		case "network":
+			// orchestrate uses this to choose the client's address.
+		case "verify":
+			if options.Verify, err = strconv.ParseBool(value); err != nil {
+				return options, fmt.Errorf("invalid verify option %s", value)
+			}
+		default:
+			return options, fmt.Errorf("unknown option %s", key)
+		}
+	}
+
+	// The username also says how the ident server answers.
+	if options.Ident, err = ParseIdentReply(options.Username); err != nil {
+		return options, err
+	}
+
+	// SASL needs the "sasl" capability.
+	if options.SASL != "" {
+		if _, err = NewSASLMech(options.SASL, "", ""); err != nil {
+			return options, err
+		}
+		found := false
+		for _, name := range options.Caps {
+			found = found || name == "sasl"
+		}
+		if !found {
+			options.Caps = append(options.Caps, "sasl")
+		}
+	}
+	return options, nil
 }
 
 // createClient connects a new client to an IRC server.
-// Syntax: `CLIENT <name>[@<other>] server[:port][/tls] [username]`
+// Syntax: `CLIENT <name>[@<other>] server[:port][/tls] [username]
+// [<key>=<value> ...]`
 func createClient(argv []string, textChan chan<- TextLine) {
 	// Parse argv[].
-	name, server, username := argv[1], argv[2], ""
-	if argc := len(argv); argc > 3 {
-		username = argv[3]
+	if len(argv) < 3 {
+		report.Errorf(lineno, "COMMAND CLIENT :expected CLIENT <name> <server>")
+		return
 	}
-	fmt.Printf("CLIENT %s %s %s\n", name, server, username)
+	name, server := argv[1], argv[2]
+	options, err := parseClientOptions(argv[3:])
+	if err != nil {
+		report.Errorf(lineno, "COMMAND CLIENT :%v", err)
+		return
+	}
+	fmt.Printf("CLIENT %s %s %s\n", name, server, options.Username)
 
-	client := NewClient(name, server, username, textChan)
+	client := NewClient(name, server, options, textChan)
 	clients[client.Nickname] = client
 }
 
-// executeLine executes one line of script.
+// executeLine executes one line of script, already split into `parts`.
 // It returns false on success, and true if the line should be retried.
-func executeLine(text string, textChan chan<- TextLine) bool {
-	parts := ScriptSplitLine(text)
-	if parts == nil {
+func executeLine(parts []string, text string, textChan chan<- TextLine) bool {
+	// Are we reading the body of an EXPECT ALL or EXPECT ANY?
+	if pendingExpect != nil {
+		switch parts[0] {
+		case "MATCH":
+			doMatch(parts[1:])
+		case "END":
+			doEnd()
+		default:
+			report.Errorf(lineno, "COMMAND %s :expected MATCH or END", parts[0])
+		}
 		return false
 	}
 
@@ -172,27 +493,77 @@ func executeLine(text string, textChan chan<- TextLine) bool {
 		// do nothing; this is handled by the orchestrator
 	case "CLIENT":
 		createClient(parts, textChan)
+	case "DELAY":
+		doDelay(parts[1:])
+	case "DROP":
+		doDrop(parts[1:])
+	case "DNS":
+		doDNS(parts[1:])
+	case "DNSBL":
+		doDNSBL(parts[1:])
 	case "EXPECT":
-		addExpect(parts[1], parts[2])
+		doExpect(parts[1:])
+	case "EXPECT-NOT":
+		doExpectNot(parts[1:])
+	case "FAULT":
+		doFault(parts[1:])
+	case "HEAL":
+		doHeal(parts[1:])
+	case "KILL", "REHASH", "RESTART", "START":
+		return doContainer(parts[0], parts[1:])
+	case "LET":
+		doLet(parts[1:])
+	case "LINK":
+		doLink(parts[1:])
+	case "NETWORK":
+		// do nothing; this is handled by the orchestrator
+	case "PROXY":
+		// do nothing; this is handled by the orchestrator
+	case "RECONFIG":
+		return doReconfig(parts[1:])
 	case "SERVER":
 		// do nothing; this is handled by the orchestrator
 	case "SEND":
 		return doSendText(parts[1], parts[2])
+	case "SET":
+		doSet(parts[1:])
+	case "SPLIT":
+		doSplit(parts[1:])
 	case "SUFFIX":
 		Suffix = parts[1]
 	case "WAIT":
-		return doWait(parts[1:])
+		doWait(parts[1:])
 	default:
-		fmt.Printf("ERROR COMMAND %s :%s\n", parts[0], text)
+		report.Errorf(lineno, "COMMAND %s :%s", parts[0], text)
 	}
 
 	return false
 }
 
-var retryLine string
+// wake makes the main loop re-check whether the script can continue.
+// It is safe to call from any goroutine.
+func wake() {
+	select {
+	case wakeChan <- struct{}{}:
+	default:
+	}
+}
+
+// wakeAfter calls wake() after `d` has elapsed.
+func wakeAfter(d time.Duration) {
+	time.AfterFunc(d, wake)
+}
+
+// doWork processes one event or script line, and returns true if the
+// script should continue.
+// It blocks only when the script cannot proceed until an event occurs.
+func doWork(signalChannel <-chan os.Signal, textChan chan TextLine) bool {
+	// Can the script make progress without waiting for an event?
+	var ready <-chan struct{}
+	if !blocked && (len(waitClients) == 0 || checkWaitClients()) {
+		ready = closedChan
+	}
 
-// doWork processes I/O and returns true if the script should continue.
-func doWork(signalChannel <-chan os.Signal, textChan chan TextLine, s *bufio.Scanner) bool {
 	select {
 	case sig := <-signalChannel:
 		if sig == syscall.SIGTERM || sig == syscall.SIGINT {
@@ -202,40 +573,24 @@ func doWork(signalChannel <-chan os.Signal, textChan chan TextLine, s *bufio.Sca
 		fmt.Printf("ERROR SIGNAL %d :Unexpected %s\n", sig, sig.String())
 
 	case text := <-textChan:
-		text.Handle()
-		return true
-
-	default:
-		// Are we waiting for any clients?
-		if len(waitClients) > 0 && !checkWaitClients() {
-			time.Sleep(300 * time.Millisecond)
-			return true
+		if !text.Handle() {
+			return false
 		}
 
-		// Do we need to read a new line from the file?
-		if retryLine == "" {
-			if !s.Scan() {
-				if err := s.Err(); err != nil {
-					log.Printf("error scanning input: %v", err)
-				} else {
-					log.Printf("end of script (%v)", err)
-				}
-				return false
-			}
-			retryLine = s.Text()
-			log.Printf("%s\n", retryLine)
+	case exp := <-timeoutChan:
+		if !expireExpectation(exp) {
+			return false
 		}
 
-		// Execute it.
-		if !executeLine(retryLine, textChan) {
-			retryLine = ""
-		}
+	case <-wakeChan:
+		// A client registered or a rate-limiting delay ended.
 
-		return true
+	case <-ready:
+		return runScript(textChan)
 	}
 
-	log.Fatal("ERROR SELECT :fell off end of doWork")
-	return false
+	blocked = false
+	return true
 }
 
 func main() {
@@ -245,43 +600,80 @@ func main() {
 	signal.Notify(signalChannel, syscall.SIGTERM)
 
 	// Open our input script.
+	flag.Parse()
+	if *replayMode {
+		if err := replay(flag.Args()); err != nil {
+			fmt.Fprintf(os.Stderr, "replay failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	scriptName := "/etc/irc.script"
-	if len(os.Args) > 1 {
-		scriptName = os.Args[1]
+	if flag.NArg() > 0 {
+		scriptName = flag.Arg(0)
 	}
+	report.Script = scriptName
 	input, err := os.Open(scriptName)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to open %s: %v\n", scriptName, err)
 		os.Exit(1)
 	}
 
+	// Load it, so blocks can be matched up before anything runs.
+	script, err = LoadScript(input, scriptName, os.DirFS(*libDir))
+	_ = input.Close()
+	if err != nil {
+		report.Errorf(0, "INPUT :%v", err)
+		finish()
+	}
+
 	// Start our ident server.
 	if err := ident.Listen(); err != nil {
 		fmt.Printf("failed to listen for ident: %v\n", err)
 	}
 
+	// Start our DNS server, if orchestrate gave us hosts to serve.
+	if err := startDNS(); err != nil {
+		fmt.Printf("failed to start DNS server: %v\n", err)
+	}
+
 	// Run the main event loop.
 	go ident.Serve()
 	textChan := make(chan TextLine, 64)
 
-	// Create a scanner, which will panic if the input line is too long.
-	s := bufio.NewScanner(input)
-	s.Buffer(make([]byte, 32768), 512)
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Printf("ERROR INPUT :%v\n", r)
+			report.Errorf(lineno, "INPUT :%v", r)
 		}
+		finish()
 	}()
 
 	// Work until we cannot.
-	for doWork(signalChannel, textChan, s) {
+	for doWork(signalChannel, textChan) {
+	}
+}
+
+// finish writes the script's reports, closes everything and exits.
+// The exit status is non-zero if any check failed.
+func finish() {
+	finishReport()
+	fmt.Printf("script ran for %v\n", time.Since(report.Start))
+	if err := report.WriteFiles(*reportDir); err != nil {
+		fmt.Printf("failed to write reports: %v\n", err)
 	}
 
 	// Close everything.
-	fmt.Printf("shutting down")
+	fmt.Printf("shutting down\n")
 	for _, c := range clients {
 		_ = c.Close()
 	}
 	_ = ident.Close()
-	_ = input.Close()
+	if dns != nil {
+		_ = dns.Close()
+	}
+
+	if report.Failed() {
+		fmt.Printf("script failed\n")
+		os.Exit(1)
+	}
 }
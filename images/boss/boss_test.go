@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSendUnregistered(t *testing.T) {
+	client := newTestClient(t, "user1")
+
+	// While the client is registering, SEND waits.
+	if !doSendText("user1", "JOIN #test") {
+		t.Errorf("SEND did not wait for a registering client")
+	}
+
+	// Once its connection fails, SEND reports an error instead.
+	client.fail(errors.New("handshake failed"))
+	nResults := len(report.Results())
+	if doSendText("user1", "JOIN #test") {
+		t.Errorf("SEND waited for a client that failed to register")
+	}
+	results := report.Results()
+	if len(results) != nResults+1 || !strings.Contains(results[nResults].Message, "user1 not registered") {
+		t.Errorf("SEND to a failed client reported %+v", results[nResults:])
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// capState tracks a client's IRCv3 capabilities.
+// It is protected by the client's `registeredCond.L`.
+type capState struct {
+	// available maps capabilities that the server offers to their
+	// values (which are often empty).
+	available map[string]string
+
+	// enabled holds the capabilities that the server acknowledged.
+	enabled map[string]bool
+
+	// negotiating is true between sending `CAP LS` and `CAP END` during
+	// registration.
+	negotiating bool
+
+	// pending counts `CAP REQ` messages sent during registration that
+	// have not yet been acknowledged or rejected.
+	pending int
+}
+
+// splitCaps splits a capability list into names and values.
+func splitCaps(list string) map[string]string {
+	caps := make(map[string]string)
+	for _, token := range strings.Fields(list) {
+		name, value, _ := strings.Cut(token, "=")
+		caps[name] = value
+	}
+	return caps
+}
+
+// Caps returns the client's enabled capabilities, sorted by name.
+func (c *ClientConn) Caps() []string {
+	c.registeredCond.L.Lock()
+	defer c.registeredCond.L.Unlock()
+	caps := make([]string, 0, len(c.caps.enabled))
+	for name := range c.caps.enabled {
+		caps = append(caps, name)
+	}
+	sort.Strings(caps)
+	return caps
+}
+
+// HasCap returns true if the client has the capability `name` enabled.
+func (c *ClientConn) HasCap(name string) bool {
+	c.registeredCond.L.Lock()
+	defer c.registeredCond.L.Unlock()
+	return c.caps.enabled[name]
+}
+
+// handleCap processes a CAP message from the server.
+// During registration, it returns the lines to send in response;
+// afterwards, it only tracks changes to the client's capabilities, so
+// that scripts can send `CAP REQ` themselves.
+func (c *ClientConn) handleCap(msg *Message) []string {
+	if len(msg.Params) < 3 {
+		return nil
+	}
+
+	c.registeredCond.L.Lock()
+	defer c.registeredCond.L.Unlock()
+	cs := &c.caps
+	list := msg.Params[len(msg.Params)-1]
+	switch strings.ToUpper(msg.Params[1]) {
+	case "LS":
+		for name, value := range splitCaps(list) {
+			cs.available[name] = value
+		}
+
+		// Is this the last line of the list?
+		if !cs.negotiating || msg.Params[2] == "*" {
+			return nil
+		}
+		var req []string
+		for _, name := range c.Options.Caps {
+			if _, ok := cs.available[name]; ok {
+				req = append(req, name)
+			}
+		}
+		if len(req) == 0 {
+			return c.endCapNegotiation()
+		}
+		cs.pending++
+		return []string{"CAP REQ :" + strings.Join(req, " ")}
+
+	case "ACK":
+		for name := range splitCaps(list) {
+			if strings.HasPrefix(name, "-") {
+				delete(cs.enabled, name[1:])
+			} else {
+				cs.enabled[name] = true
+			}
+		}
+		return c.capReplied()
+
+	case "NAK":
+		return c.capReplied()
+
+	case "NEW":
+		for name, value := range splitCaps(list) {
+			cs.available[name] = value
+		}
+
+	case "DEL":
+		for name := range splitCaps(list) {
+			delete(cs.available, name)
+			delete(cs.enabled, name)
+		}
+	}
+
+	return nil
+}
+
+// capReplied handles an ACK or NAK for a `CAP REQ`.  Once all of the
+// registration requests are answered, it starts SASL authentication
+// or ends negotiation.
+func (c *ClientConn) capReplied() []string {
+	if !c.caps.negotiating || c.caps.pending == 0 {
+		return nil
+	}
+	if c.caps.pending--; c.caps.pending > 0 {
+		return nil
+	}
+	if c.Options.SASL != "" && c.caps.enabled["sasl"] {
+		return c.startSASL()
+	}
+	return c.endCapNegotiation()
+}
+
+// endCapNegotiation finishes capability negotiation during
+// registration.
+func (c *ClientConn) endCapNegotiation() []string {
+	c.caps.negotiating = false
+	return []string{"CAP END"}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// newCapClient returns a client that is negotiating capabilities during
+// registration, as after sending `CAP LS 302`.
+func newCapClient(options ClientOptions) *ClientConn {
+	return &ClientConn{
+		Name:           "a",
+		Nickname:       "a",
+		Options:        options,
+		registeredCond: sync.NewCond(&sync.Mutex{}),
+		caps: capState{
+			available:   make(map[string]string),
+			enabled:     make(map[string]bool),
+			negotiating: true,
+		},
+	}
+}
+
+func TestHandleCap(t *testing.T) {
+	type step struct {
+		line  string
+		reply []string
+	}
+	tests := []struct {
+		name    string
+		options ClientOptions
+		steps   []step
+		enabled []string
+	}{
+		{"ls ack", ClientOptions{Caps: []string{"sasl", "server-time", "away-notify"}}, []step{
+			{":irc CAP * LS :multi-prefix sasl=PLAIN,EXTERNAL server-time", []string{"CAP REQ :sasl server-time"}},
+			{":irc CAP a ACK :sasl server-time", []string{"CAP END"}},
+		}, []string{"sasl", "server-time"}},
+		{"ls 302 continuation", ClientOptions{Caps: []string{"away-notify", "sasl"}}, []step{
+			{":irc CAP * LS * :multi-prefix sasl", nil},
+			{":irc CAP * LS * :server-time", nil},
+			{":irc CAP * LS :away-notify", []string{"CAP REQ :away-notify sasl"}},
+			{":irc CAP a ACK :away-notify sasl", []string{"CAP END"}},
+		}, []string{"away-notify", "sasl"}},
+		{"nak", ClientOptions{Caps: []string{"sasl"}}, []step{
+			{":irc CAP * LS :sasl", []string{"CAP REQ :sasl"}},
+			{":irc CAP a NAK :sasl", []string{"CAP END"}},
+		}, []string{}},
+		{"none wanted", ClientOptions{Caps: []string{"echo-message"}}, []step{
+			{":irc CAP * LS :sasl server-time", []string{"CAP END"}},
+		}, []string{}},
+		{"sasl", ClientOptions{Caps: []string{"sasl"}, SASL: "plain", Password: "pw"}, []step{
+			{":irc CAP * LS :sasl", []string{"CAP REQ :sasl"}},
+			{":irc CAP a ACK :sasl", []string{"AUTHENTICATE PLAIN"}},
+		}, []string{"sasl"}},
+		{"sasl nak", ClientOptions{Caps: []string{"sasl"}, SASL: "plain", Password: "pw"}, []step{
+			{":irc CAP * LS :sasl", []string{"CAP REQ :sasl"}},
+			{":irc CAP a NAK :sasl", []string{"CAP END"}},
+		}, []string{}},
+		{"after registration", ClientOptions{Caps: []string{"sasl"}}, []step{
+			{":irc CAP * LS :sasl away-notify", []string{"CAP REQ :sasl"}},
+			{":irc CAP a ACK :sasl", []string{"CAP END"}},
+			{":irc CAP a ACK :away-notify", nil},
+			{":irc CAP a ACK :-sasl", nil},
+			{":irc CAP a NAK :echo-message", nil},
+			{":irc CAP a NEW :echo-message", nil},
+			{":irc CAP a ACK :echo-message", nil},
+			{":irc CAP a DEL :away-notify", nil},
+		}, []string{"echo-message"}},
+		{"short", ClientOptions{Caps: []string{"sasl"}}, []step{
+			{":irc CAP * LS", nil},
+		}, []string{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newCapClient(tc.options)
+			for _, s := range tc.steps {
+				msg, err := ParseMessage(s.line)
+				if err != nil {
+					t.Fatalf("ParseMessage(%q) failed: %v", s.line, err)
+				}
+				if reply := c.handleCap(msg); !reflect.DeepEqual(reply, s.reply) {
+					t.Errorf("handleCap(%q) = %q; want %q", s.line, reply, s.reply)
+				}
+			}
+			if caps := c.Caps(); !reflect.DeepEqual(caps, tc.enabled) {
+				t.Errorf("Caps() = %q; want %q", caps, tc.enabled)
+			}
+		})
+	}
+}
+
+func TestHandleCapAvailable(t *testing.T) {
+	c := newCapClient(ClientOptions{Caps: []string{}})
+	for _, line := range []string{
+		":irc CAP * LS * :sasl=PLAIN,EXTERNAL multi-prefix",
+		":irc CAP * LS :server-time",
+		":irc CAP a NEW :draft/chathistory=100",
+		":irc CAP a DEL :multi-prefix",
+	} {
+		msg, err := ParseMessage(line)
+		if err != nil {
+			t.Fatalf("ParseMessage(%q) failed: %v", line, err)
+		}
+		c.handleCap(msg)
+	}
+	want := map[string]string{
+		"sasl":              "PLAIN,EXTERNAL",
+		"server-time":       "",
+		"draft/chathistory": "100",
+	}
+	if !reflect.DeepEqual(c.caps.available, want) {
+		t.Errorf("available = %q; want %q", c.caps.available, want)
+	}
+	if c.caps.negotiating {
+		t.Errorf("still negotiating after the last LS line")
+	}
+}
@@ -3,17 +3,53 @@ package main
 import (
 	"bufio"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
-	"regexp"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 )
 
+// ClientOptions holds the optional settings from a CLIENT command.
+type ClientOptions struct {
+	// Username is the username from the CLIENT command, or empty to not
+	// give the client an ident response.
+	Username string
+
+	// Ident says how the ident server answers for the client, if
+	// Username is not empty.
+	Ident IdentReply
+
+	// Caps lists the capabilities to request during registration.
+	// If it is nil, the client does not negotiate capabilities.
+	Caps []string
+
+	// SASL is the SASL mechanism to authenticate with during
+	// registration, or empty to not use SASL.
+	SASL string
+
+	// Account and Password are the SASL credentials.
+	// If Account is empty, the client's nickname is used.
+	Account, Password string
+
+	// Cert names a PEM file holding the client's TLS certificate and
+	// private key, or is empty to not present a certificate.
+	Cert string
+
+	// Verify is true to check the server's TLS certificate against the
+	// testnet CA and the server's name.
+	Verify bool
+
+	// Network is "tcp4" or "tcp6" to connect using that address family,
+	// or empty to use either.
+	Network string
+}
+
 // ClientConn represents a connection to an IRC server.
 type ClientConn struct {
 	// Name is the unique name assigned for this client.
@@ -28,8 +64,17 @@ type ClientConn struct {
 	// Server is the name of the server this client connected to.
 	Server string
 
+	// CaseMapping is the server's CASEMAPPING, from RPL_ISUPPORT.
+	CaseMapping string
+
 	// Expect is a list of regular expressions we expect this client to see.
-	Expect []Expectation
+	Expect []*Expectation
+
+	// Reject is a list of regular expressions this client must not see.
+	Reject []*Expectation
+
+	// Options holds the client's settings from the script.
+	Options ClientOptions
 
 	// conn is the underlying network connection.
 	conn net.Conn
@@ -45,24 +90,31 @@ type ClientConn struct {
 	// registered is set to true once the client is fully registered.
 	registered bool
 
-	// registeredCond is a condition variable around `registered`.
+	// runErr is why the connection ended before the client registered,
+	// or nil.  It is protected by `registeredCond.L`.
+	runErr error
+
+	// registeredCond is a condition variable around `registered` and
+	// `runErr`.
 	// `registeredCond.L` is also used to serialize sending data.
 	registeredCond *sync.Cond
 
 	// vars is a map of captured variables for this client.
 	vars map[string]string
-}
 
-// Expectation records one expected line from a server.
-type Expectation struct {
-	// Pattern describes what we want to match.
-	Pattern *regexp.Regexp
+	// caps tracks the client's capabilities.
+	caps capState
+
+	// sasl tracks the client's SASL exchange.
+	sasl saslState
 
-	// Deadline is the time at which we give up on the expectation.
-	Deadline time.Time
+	// account is the services account the client is logged in to.
+	// It is protected by `registeredCond.L`.
+	account string
 
-	// Fatal is true if a failed expectation should stop the script.
-	Fatal bool
+	// transcript records the client's session, or is nil if its file
+	// could not be opened.
+	transcript *Transcript
 }
 
 // TextLine represents one line of received text.
@@ -78,50 +130,103 @@ type TextLine struct {
 	// If an error occurs, it will be the last TextLine from the
 	// goroutine.
 	Err error
+
+	// Early is true if the line arrived during registration, so it has
+	// already been handled like a PING or CAP would be.
+	Early bool
 }
 
 // Handle processes an incoming line of text for a client.
-func (tl *TextLine) Handle() {
+// Returns false if the line failed a fatal check, so the script should
+// stop.
+func (tl *TextLine) Handle() bool {
 	// Was there a read error?
 	if tl.Err != nil {
 		fmt.Printf("ERROR CLIENT %s :%v\n", tl.Source.Name, tl.Err)
-		return
+		return true
 	}
 
-	// If there was no source prefix, add one.
-	if tl.Text[0] != ':' && tl.Source.Server != "" {
-		tl.Text = fmt.Sprintf(":%s %s", tl.Source.Server, tl.Text)
+	// Parse the line.  If there was no source prefix, add one.
+	msg, err := ParseMessage(tl.Text)
+	if err != nil {
+		fmt.Printf("WARNING CLIENT %s :%v in %q\n", tl.Source.Name, err, tl.Text)
+	} else if msg.Source == "" && tl.Source.Server != "" {
+		msg.Source = tl.Source.Server
+		tl.Text = addSource(tl.Text, msg.Source)
 	}
 
 	// Does it match an expectation?
 	if len(tl.Source.Expect) > 0 {
-		if m := tl.Source.Expect[0].Pattern.FindStringSubmatch(tl.Text); m != nil {
-			// Save any named subexpressions.
-			for idx, name := range tl.Source.Expect[0].Pattern.SubexpNames() {
-				if name != "" {
-					tl.Source.vars[name] = m[idx]
-				}
-			}
+		exp := tl.Source.Expect[0]
+		if exp.Accept(tl.Text) {
+			exp.timer.Stop()
+			report.Add(exp.Result(Matched, ""))
+			tl.Source.RemoveExpect(exp)
+		}
+	}
+
+	// Does it match something the client should not see?
+	ok := true
+	for ii := 0; ii < len(tl.Source.Reject); {
+		exp := tl.Source.Reject[ii]
+		if !exp.Hits(tl.Text) {
+			ii++
+			continue
+		}
 
-			// Drop this expectation.
-			n := copy(tl.Source.Expect, tl.Source.Expect[1:])
-			tl.Source.Expect = tl.Source.Expect[:n]
+		exp.timer.Stop()
+		tl.Source.RemoveExpect(exp)
+		if exp.Fatal {
+			fmt.Printf("ERROR EXPECT-NOT %s :%s matched %s\n",
+				tl.Source.Name, exp.Where(), tl.Text)
+			report.Add(exp.Result(Fatal, "matched "+tl.Text))
+			ok = false
+		} else {
+			fmt.Printf("WARNING EXPECT-NOT %s :%s matched %s\n",
+				tl.Source.Name, exp.Where(), tl.Text)
+			report.Add(exp.Result(Unexpected, "matched "+tl.Text))
 		}
 	}
 
 	// Handle commands like PING.
-	f := strings.Fields(tl.Text)
-	if f[1] == "PING" {
-		tl.Source.Send("PONG :" + f[len(f)-1])
+	if msg == nil || tl.Early {
+		return ok
+	}
+	switch msg.Command {
+	case "CAP":
+		tl.Source.handleCap(msg)
+	case "900", "901":
+		tl.Source.handleSASLNumeric(msg)
+	case "PING":
+		tl.Source.Send("PONG :" + msg.Param(len(msg.Params)-1))
+	case "005":
+		// The first parameter is our nickname, and the last is text.
+		for ii := 1; ii < len(msg.Params)-1; ii++ {
+			if v, found := strings.CutPrefix(msg.Params[ii], "CASEMAPPING="); found {
+				tl.Source.CaseMapping = v
+			}
+		}
 	}
+
+	return ok
+}
+
+// addSource inserts `source` as the source of the IRC line `text`,
+// after any message tags.
+func addSource(text, source string) string {
+	tags := ""
+	if text[0] == '@' {
+		idx := strings.IndexByte(text, ' ')
+		tags, text = text[:idx+1], strings.TrimLeft(text[idx+1:], " ")
+	}
+	return tags + ":" + source + " " + text
 }
 
 // NewClient creates a new client with the specified (decorated) name,
-// server and username.
+// server and options.
 // `name` should be <name>[@<other>].
 // `server` should be <server>[:<port>][/tls].
-// `username` may be empty to not give the client an ident response.
-func NewClient(name, server, username string, textChan chan<- TextLine) *ClientConn {
+func NewClient(name, server string, options ClientOptions, textChan chan<- TextLine) *ClientConn {
 	// Split nickname from the rest of `name`.
 	nickname, host, hosted := strings.Cut(name, "@")
 	if !hosted {
@@ -133,21 +238,48 @@ func NewClient(name, server, username string, textChan chan<- TextLine) *ClientC
 		Name:           nickname,
 		Nickname:       nickname,
 		Server:         server, // may be modified by client.Run()
+		Options:        options,
 		registeredCond: sync.NewCond(&sync.Mutex{}),
+		vars:           make(map[string]string),
+		caps: capState{
+			available: make(map[string]string),
+			enabled:   make(map[string]bool),
+		},
+	}
+
+	// Record its session.
+	transcript, err := OpenTranscript(filepath.Join(*reportDir, "transcripts"), nickname)
+	if err != nil {
+		fmt.Printf("WARNING CLIENT %s :no transcript: %v\n", nickname, err)
+	} else {
+		client.transcript = transcript
 	}
 
 	// Launch it.  This will also register the ident response, if needed.
-	go client.Run(host, username, textChan)
+	go client.Run(host, textChan)
 
 	// Return the new client.
 	return client
 }
 
-// Close closes the connection.
+// Close closes the connection and the client's transcript.
 func (c *ClientConn) Close() error {
+	_ = c.transcript.Close()
 	return c.conn.Close()
 }
 
+// write records each line of `text`, which holds one or more lines
+// ending with CR LF, in the client's transcript, then sends `text`.
+func (c *ClientConn) write(text string) error {
+	for _, line := range strings.SplitAfter(text, "\r\n") {
+		if line != "" {
+			c.transcript.Record(DirSend, strings.TrimSuffix(line, "\r\n"))
+		}
+	}
+	_, err := io.WriteString(c.conn, text)
+	return err
+}
+
 // CopyLines reads lines from c, delivering them to textChan.
 // It will typically be run as a goroutine.
 func (c *ClientConn) CopyLines(textChan chan<- TextLine) {
@@ -157,52 +289,88 @@ func (c *ClientConn) CopyLines(textChan chan<- TextLine) {
 	defer func() {
 		if r := recover(); r != nil {
 			// c.scanner.Scan() only panics with a string.
-			msg.Err = errors.New(r.(string))
-			textChan <- msg
+			c.closed(textChan, errors.New(r.(string)))
 		} else {
-			msg.Err = c.scanner.Err()
-			if msg.Err == nil {
-				msg.Err = io.EOF
+			err := c.scanner.Err()
+			if err == nil {
+				err = io.EOF
 			}
-			textChan <- msg
+			c.closed(textChan, err)
 		}
 	}()
 
 	for c.scanner.Scan() {
 		msg.Text = c.scanner.Text()
 		fmt.Printf("%s <- %s\n", c.Name, msg.Text)
+		c.transcript.Record(DirRecv, msg.Text)
 		textChan <- msg
 	}
 }
 
-// Expand will expand any named variables in `text`.
-func (c *ClientConn) Expand(text string) string {
-	return os.Expand(text, func(name string) string {
-		switch name {
-		case "me":
-			return c.Nickname
-		case "channel":
-			return c.LastJoined
-		default:
-			v, ok := c.vars[name]
-			if !ok {
-				panic("unknown client variable " + name)
-			}
-			return v
+// Pending returns true if the client has expectations that are not yet
+// resolved, including negative expectations.
+func (c *ClientConn) Pending() bool {
+	return len(c.Expect) > 0 || len(c.Reject) > 0
+}
+
+// RemoveExpect removes `exp` from the client's expectations (or, for a
+// negative expectation, from its rejections).
+// Returns true if it was found.
+func (c *ClientConn) RemoveExpect(exp *Expectation) bool {
+	list := &c.Expect
+	if exp.Negate {
+		list = &c.Reject
+	}
+	for idx, e := range *list {
+		if e == exp {
+			n := copy((*list)[idx:], (*list)[idx+1:])
+			(*list)[idx+n] = nil
+			*list = (*list)[:idx+n]
+			return true
 		}
+	}
+	return false
+}
+
+// Expand will expand any named variables in `text`.
+// See ExpandVars() for the meaning of `mode`, and lookupVar() for the
+// supported forms of variable reference.
+func (c *ClientConn) Expand(text string, mode ExpandMode) (string, error) {
+	return ExpandVars(text, mode, func(name string) (string, error) {
+		return lookupVar(c, name)
 	})
 }
 
+// Lookup returns the value of the client variable `name`, and whether
+// it was found.
+func (c *ClientConn) Lookup(name string) (string, bool) {
+	switch name {
+	case "me":
+		return c.Nickname, true
+	case "channel":
+		return c.LastJoined, true
+	case "caps":
+		return strings.Join(c.Caps(), " "), true
+	case "account":
+		return c.Account(), true
+	default:
+		v, ok := c.vars[name]
+		return v, ok
+	}
+}
+
 // RateLimit applies rate limiting for a client command.
-func (c *ClientConn) RateLimit(text string) {
+// It returns how long the client must wait before sending `text`, or
+// zero if `text` can be sent now (in which case its cost is charged).
+func (c *ClientConn) RateLimit(text string) time.Duration {
 	// Calculate how far ahead we can burst.
 	now := time.Now()
 	limit := now.Add(time.Duration(9) * time.Second)
 
 	// Compare c.since to the limits.
 	if c.since.After(limit) {
-		// Sleep until we get close enough to c.Since.
-		time.Sleep(c.since.Sub(limit))
+		// Wait until we get close enough to c.Since.
+		return c.since.Sub(limit)
 	} else if now.After(c.since) {
 		// Update c.Since to now.
 		c.since = now
@@ -211,45 +379,79 @@ func (c *ClientConn) RateLimit(text string) {
 	// Add the cost of this message to c.Since.
 	cost := time.Second * time.Duration(2+len(text)/120)
 	c.since = c.since.Add(cost)
+	return 0
+}
+
+// Registered returns true if the client has finished registration.
+func (c *ClientConn) Registered() bool {
+	c.registeredCond.L.Lock()
+	defer c.registeredCond.L.Unlock()
+	return c.registered
+}
+
+// RunErr returns why the client's connection ended before it
+// registered, or nil if it registered or is still registering.
+func (c *ClientConn) RunErr() error {
+	c.registeredCond.L.Lock()
+	defer c.registeredCond.L.Unlock()
+	return c.runErr
+}
+
+// closed records in the client's transcript that its connection ended
+// because of `err`, and delivers `err` to textChan.
+// This is the only place that records the end of a connection, so the
+// transcript has one entry for it.
+func (c *ClientConn) closed(textChan chan<- TextLine, err error) {
+	c.transcript.Record(DirClose, err.Error())
+	textChan <- TextLine{Source: c, Err: err}
+}
+
+// fail records that the client's connection ended before it registered,
+// and wakes anything that waits for it to register.
+// The caller should also call closed().
+func (c *ClientConn) fail(err error) {
+	c.registeredCond.L.Lock()
+	c.runErr = err
+	c.registeredCond.Broadcast()
+	c.registeredCond.L.Unlock()
+	wake()
 }
 
 // Send expands `text` and sends the client with optional rate-limiting.
 func (c *ClientConn) Send(text string) {
 	// Interpret selected commands like NICK and JOIN.
-	f := strings.Fields(text)
-	switch f[0] {
-	case "JOIN":
-		idx := strings.LastIndexByte(f[1], ',')
-		c.LastJoined = f[1][idx+1:] // idx == -1 works here
-	case "NICK":
-		c.Nickname = f[1]
+	if msg, err := ParseMessage(text); err == nil && len(msg.Params) > 0 {
+		switch strings.ToUpper(msg.Command) {
+		case "JOIN":
+			idx := strings.LastIndexByte(msg.Params[0], ',')
+			c.LastJoined = msg.Params[0][idx+1:] // idx == -1 works here
+		case "NICK":
+			c.Nickname = msg.Params[0]
+		}
 	}
 
 	// Make sure we are registered before sending.
 	c.registeredCond.L.Lock()
 	defer c.registeredCond.L.Unlock()
-	for !c.registered {
+	for !c.registered && c.runErr == nil {
 		c.registeredCond.Wait()
 	}
+	if c.runErr != nil {
+		fmt.Printf("ERROR SOCKET %s :not registered: %v\n", c.Name, c.runErr)
+		return
+	}
 
 	// Send it.
-	if _, err := io.WriteString(c.conn, text+"\r\n"); err != nil {
+	if err := c.write(text + "\r\n"); err != nil {
 		fmt.Printf("ERROR SOCKET %s :%v\n", c.Name, err)
 	}
 }
 
-// NTuple describes the client's connection.
-func (c *ClientConn) NTuple() (res NTuple) {
-	res.LocalAddr, res.LocalPort = SplitAddress(c.conn.LocalAddr().String())
-	res.RemoteAddr, res.RemotePort = SplitAddress(c.conn.RemoteAddr().String())
-	return res
-}
-
 // finishRegistration finishes the client's registration.
 // This waits until the server sends an 001 (WELCOME) message, and
-// handles any PING before that.
-// Returns true on success, false if something went wrong.
-func (c *ClientConn) finishRegistration() {
+// handles any PING, CAP or SASL exchange before that.
+// Each line is also delivered to `textChan`, so scripts can expect it.
+func (c *ClientConn) finishRegistration(textChan chan<- TextLine) {
 	// c.scanner.Scan() will panic with a string on an overly long line.
 	defer func() {
 		if r := recover(); r != nil {
@@ -258,6 +460,7 @@ func (c *ClientConn) finishRegistration() {
 		}
 	}()
 
+	welcomed := false
 scanLoop:
 	for c.scanner.Scan() {
 		// Was there an error reading the line?
@@ -269,25 +472,86 @@ scanLoop:
 		// See if the line is a type that we handle specially.
 		text := c.scanner.Text()
 		fmt.Printf("%s <- %s\n", c.Name, text)
-		f := IrcSplitLine(text)
-		lf := len(f)
-		switch f[1] {
+		c.transcript.Record(DirRecv, text)
+		textChan <- TextLine{Source: c, Text: text, Early: true}
+		msg, err := ParseMessage(text)
+		if err != nil {
+			continue
+		}
+		switch msg.Command {
 		case "001":
+			welcomed = true
 			break scanLoop
+		case "CAP":
+			c.sendEarly(c.handleCap(msg))
+		case "AUTHENTICATE":
+			c.sendEarly(c.handleAuthenticate(msg))
+		case "900", "901", "902", "903", "904", "905", "906", "907":
+			c.sendEarly(c.handleSASLNumeric(msg))
 		case "PING":
-			pong := fmt.Sprintf("PONG :%s\r\n", f[lf-1])
-			_, _ = io.WriteString(c.conn, pong)
+			pong := fmt.Sprintf("PONG :%s\r\n", msg.Param(len(msg.Params)-1))
+			_ = c.write(pong)
 		}
 	}
 
-	// Record that we are registered.
+	// If the connection ended first, we did not register.
+	if !welcomed {
+		return
+	}
+
+	// Record that we are registered, and wake the script runner.
+	c.registeredCond.L.Lock()
 	c.registered = true
 	c.registeredCond.Broadcast()
+	c.registeredCond.L.Unlock()
+	wake()
+}
+
+// sendEarly sends `lines` to the server during registration, bypassing
+// Send()'s wait for registration.
+func (c *ClientConn) sendEarly(lines []string) {
+	for _, line := range lines {
+		_ = c.write(line + "\r\n")
+	}
+}
+
+// tlsConfig returns the TLS settings for connecting to `server`.
+func (c *ClientConn) tlsConfig(server string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         server,
+		InsecureSkipVerify: !c.Options.Verify,
+	}
+
+	// Should we check the server's certificate?
+	if c.Options.Verify {
+		caFile := filepath.Join(*tlsDir, "ca.pem")
+		pemText, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read testnet CA: %v", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pemText) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+	}
+
+	// Should we present a certificate?
+	if c.Options.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.Options.Cert, c.Options.Cert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
 }
 
 // Run connects to the server and reads data from it.
 // It is intended to run as a goroutine.
-func (c *ClientConn) Run(host, username string, textChan chan<- TextLine) {
+func (c *ClientConn) Run(host string, textChan chan<- TextLine) {
+	c.transcript.Record(DirConnect, c.Server)
+
 	// What server behaviors should we use?
 	server, useTLS := strings.CutSuffix(c.Server, "/tls")
 	server, portStr, _ := strings.Cut(server, ":")
@@ -296,34 +560,59 @@ func (c *ClientConn) Run(host, username string, textChan chan<- TextLine) {
 	}
 	server = ReplaceSuffix(server)
 
-	// Look up host names.
-	localAddr, err := net.ResolveTCPAddr("tcp", host+":0")
+	// Look up host names, in the requested address family.
+	network := c.Options.Network
+	if network == "" {
+		network = "tcp"
+	}
+	// A host or server without an address in that family is a failed
+	// check, not a reason to stop.
+	localAddr, err := net.ResolveTCPAddr(network, net.JoinHostPort(host, "0"))
 	if err != nil {
-		panic("failed to resolve host IP: " + err.Error())
+		err = fmt.Errorf("failed to resolve host IP: %v", err)
+		c.fail(err)
+		c.closed(textChan, err)
+		return
 	}
 
 	// Initiate the TCP connection.
 	dialer := &net.Dialer{LocalAddr: localAddr}
 	c.Server = net.JoinHostPort(server, portStr)
-	tcp, err := dialer.Dial("tcp", c.Server)
+	tcp, err := dialer.Dial(network, c.Server)
 	if err != nil {
-		panic("failed to connect to server: " + err.Error())
+		err = fmt.Errorf("failed to connect to server: %v", err)
+		c.fail(err)
+		c.closed(textChan, err)
+		return
 	}
 
 	// Should we report a username for this client?
-	if username == "" {
-		username = c.Nickname
-	} else {
-		ident.Conns.Store(c.NTuple(), username)
+	username := c.Nickname
+	if c.Options.Username != "" {
+		reply := c.Options.Ident
+		if reply.User == "" {
+			reply.User = c.Nickname
+		}
+		username = reply.User
+		ident.Conns.Store(TupleOf(tcp), reply)
 	}
 
 	// Should we run TLS on top of this connection?
 	if useTLS {
-		cfg := &tls.Config{
-			ServerName:         server,
-			InsecureSkipVerify: true,
+		cfg, err := c.tlsConfig(server)
+		if err != nil {
+			_ = tcp.Close()
+			c.fail(err)
+			c.closed(textChan, err)
+			return
+		}
+		tlsConn := tls.Client(tcp, cfg)
+		c.conn = tlsConn
+		if err = tlsConn.Handshake(); err != nil {
+			c.fail(err)
+			c.closed(textChan, err)
+			return
 		}
-		c.conn = tls.Client(tcp, cfg)
 	} else {
 		c.conn = tcp
 	}
@@ -332,18 +621,30 @@ func (c *ClientConn) Run(host, username string, textChan chan<- TextLine) {
 	c.scanner = bufio.NewScanner(c.conn)
 	c.scanner.Buffer(make([]byte, 2048), 512)
 
-	// Register client with IRC.
+	// Register client with IRC, negotiating capabilities if wanted.
 	// The 0 is the initial mode, the _ is unused / reserved.
 	hello := fmt.Sprintf("USER %s 0 _ :%s\r\nNICK %s\r\n",
 		username, c.Nickname, c.Nickname)
-	_, err = io.WriteString(c.conn, hello)
+	if c.Options.Caps != nil {
+		c.registeredCond.L.Lock()
+		c.caps.negotiating = true
+		c.registeredCond.L.Unlock()
+		hello = "CAP LS 302\r\n" + hello
+	}
+	err = c.write(hello)
 	if err != nil {
 		fmt.Printf("failed to register: %v\n", err)
 	}
 
 	// Try to finish registration.
-	c.finishRegistration()
-	if !c.registered {
+	c.finishRegistration(textChan)
+	if !c.Registered() {
+		err = c.scanner.Err()
+		if err == nil {
+			err = errors.New("connection closed before registration")
+		}
+		c.fail(err)
+		c.closed(textChan, err)
 		return
 	}
 
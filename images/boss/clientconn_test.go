@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runTestClient runs `client`, connecting from `host`, and returns
+// the first TextLine that it delivers.
+func runTestClient(t *testing.T, client *ClientConn, host string) TextLine {
+	t.Helper()
+	textChan := make(chan TextLine, 16)
+	go client.Run(host, textChan)
+	select {
+	case tl := <-textChan:
+		return tl
+	case <-time.After(5 * time.Second):
+		t.Fatalf("client %s did not finish", client.Name)
+	}
+	return TextLine{}
+}
+
+func TestRunTLSConfigError(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client := newTestClient(t, "user1")
+	client.Server = ln.Addr().String() + "/tls"
+	client.Options.Cert = filepath.Join(t.TempDir(), "missing.pem")
+	tl := runTestClient(t, client, "127.0.0.1")
+	if tl.Err == nil || tl.Source != client {
+		t.Fatalf("Run() delivered %+v; want an error", tl)
+	}
+	if err := client.RunErr(); err == nil {
+		t.Errorf("RunErr() = nil after a bad client certificate")
+	}
+}
+
+func TestRunConnectError(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+
+	tests := []struct {
+		name, network, host, server string
+	}{
+		{"no address in family", "tcp6", "127.0.0.1", "127.0.0.1:6667"},
+		{"connection refused", "tcp4", "127.0.0.1", closed},
+	}
+	for _, tc := range tests {
+		client := newTestClient(t, "user1")
+		client.Server = tc.server
+		client.Options.Network = tc.network
+		tl := runTestClient(t, client, tc.host)
+		if tl.Err == nil || tl.Source != client {
+			t.Errorf("%s: Run() delivered %+v; want an error", tc.name, tl)
+		}
+		if err := client.RunErr(); err == nil {
+			t.Errorf("%s: RunErr() = nil", tc.name)
+		}
+	}
+}
+
+func TestRunClosedBeforeRegistration(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	dir := t.TempDir()
+	client := newTestClient(t, "user1")
+	client.Server = ln.Addr().String()
+	if client.transcript, err = OpenTranscript(dir, client.Name); err != nil {
+		t.Fatal(err)
+	}
+	defer client.transcript.Close()
+	tl := runTestClient(t, client, "127.0.0.1")
+	if tl.Err == nil || tl.Source != client {
+		t.Fatalf("Run() delivered %+v; want an error", tl)
+	}
+	if err := client.RunErr(); err == nil {
+		t.Errorf("RunErr() = nil after the server closed the connection")
+	}
+
+	// The transcript ends the connection once.
+	data, err := os.ReadFile(filepath.Join(dir, "user1.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), `"dir":"close"`); n != 1 {
+		t.Errorf("transcript has %d close entries:\n%s", n, data)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var engineSocket = flag.String("engine", "/run/boss/engine.sock",
+	"Socket for the container engine's (Docker-compatible) API")
+var projectName = flag.String("project", os.Getenv("TESTNET_PROJECT"),
+	"Compose project that the servers belong to")
+
+// readyTimeout is how long to wait for a server's container to become
+// ready after starting it.
+const readyTimeout = 60 * time.Second
+
+// Engine is a client for the container engine's API, which boss uses to
+// start, stop and signal servers.
+// The engine's socket gives control of every container on the host, so
+// an Engine only acts on containers that Find() returns, which carry
+// the Compose labels of `Project`.
+type Engine struct {
+	// client sends requests to the engine.
+	client *http.Client
+
+	// base is the URL prefix for requests.
+	base string
+
+	// Project is the Compose project that the servers belong to.
+	Project string
+}
+
+// containerState is the part of the engine's container description that
+// we care about.
+type containerState struct {
+	State struct {
+		Status  string
+		Running bool
+		Health  *struct {
+			Status string
+		}
+	}
+}
+
+// NewEngine creates an Engine that talks to the API at `socket`.
+func NewEngine(socket, project string) *Engine {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &Engine{
+		client:  &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		base:    "http://engine/v1.41",
+		Project: project,
+	}
+}
+
+// do sends a request and decodes its JSON result into `result`, if that
+// is not nil.
+func (e *Engine) do(method, path string, query url.Values, result any) error {
+	u := e.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status,
+			strings.TrimSpace(string(body)))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Find returns the ID of the container for the Compose service
+// `service` in the project `e.Project`.
+func (e *Engine) Find(service string) (string, error) {
+	if e.Project == "" {
+		return "", errors.New("no Compose project (use -project or TESTNET_PROJECT)")
+	}
+	filters, err := json.Marshal(map[string][]string{
+		"label": {
+			"com.docker.compose.project=" + e.Project,
+			"com.docker.compose.service=" + service,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	var found []struct {
+		ID     string `json:"Id"`
+		Labels map[string]string
+	}
+	query := url.Values{"all": {"true"}, "filters": {string(filters)}}
+	if err = e.do(http.MethodGet, "/containers/json", query, &found); err != nil {
+		return "", err
+	}
+
+	// Check the labels too, in case the engine ignored the filters.
+	var ids []string
+	for _, c := range found {
+		if c.Labels["com.docker.compose.project"] == e.Project &&
+			c.Labels["com.docker.compose.service"] == service {
+			ids = append(ids, c.ID)
+		}
+	}
+	if len(ids) != 1 {
+		return "", fmt.Errorf("found %d containers for %s in project %s",
+			len(ids), service, e.Project)
+	}
+	return ids[0], nil
+}
+
+// Start starts container `id`.
+func (e *Engine) Start(id string) error {
+	return e.do(http.MethodPost, "/containers/"+id+"/start", nil, nil)
+}
+
+// Restart stops and starts container `id`.
+func (e *Engine) Restart(id string) error {
+	query := url.Values{"t": {"10"}}
+	return e.do(http.MethodPost, "/containers/"+id+"/restart", query, nil)
+}
+
+// Kill sends `signal` to the main process of container `id`.
+func (e *Engine) Kill(id, signal string) error {
+	query := url.Values{"signal": {signal}}
+	return e.do(http.MethodPost, "/containers/"+id+"/kill", query, nil)
+}
+
+// WaitState polls container `id` until it is running (and healthy, if
+// it has a health check) if `running` is true, or until it has stopped
+// if `running` is false.
+func (e *Engine) WaitState(id string, running bool, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		var cs containerState
+		if err := e.do(http.MethodGet, "/containers/"+id+"/json", nil, &cs); err != nil {
+			return err
+		}
+		if !running && !cs.State.Running {
+			return nil
+		}
+		if running && cs.State.Running &&
+			(cs.State.Health == nil || cs.State.Health.Status == "" ||
+				cs.State.Health.Status == "healthy") {
+			return nil
+		}
+		if running && (cs.State.Status == "exited" || cs.State.Status == "dead") {
+			return errors.New("container " + cs.State.Status)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting; container is %s", cs.State.Status)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// Lifecycle carries out the command `cmd` (KILL, REHASH, RESTART or
+// START) on the container for the Compose service `service`, and waits
+// for the container to stop (after `KILL <server> SIGKILL`) or to be
+// ready.  `sig` is the signal for KILL.
+func (e *Engine) Lifecycle(cmd, service, sig string) error {
+	id, err := e.Find(service)
+	if err != nil {
+		return err
+	}
+	switch cmd {
+	case "KILL":
+		if err = e.Kill(id, sig); err != nil || sig != "SIGKILL" {
+			return err
+		}
+		return e.WaitState(id, false, readyTimeout)
+	case "REHASH":
+		err = e.Kill(id, "SIGHUP")
+	case "RESTART":
+		err = e.Restart(id)
+	case "START":
+		err = e.Start(id)
+	default:
+		err = errors.New("unknown command " + cmd)
+	}
+	if err != nil {
+		return err
+	}
+	return e.WaitState(id, true, readyTimeout)
+}
+
+// engine is the container engine client, created when first needed.
+var engine *Engine
+
+// containerOp is a server lifecycle command that is running in the
+// background.
+type containerOp struct {
+	// done is closed when the command finishes.
+	done chan struct{}
+
+	// err is the command's result, once `done` is closed.
+	err error
+}
+
+// pendingContainerOp is the lifecycle command that the script is
+// waiting for, if any.
+var pendingContainerOp *containerOp
+
+// checkContainerOp checks whether the pending container command has
+// finished, and reports its error if it failed.
+// Returns true if the script should keep waiting for it.
+func checkContainerOp(cmd string) bool {
+	op := pendingContainerOp
+	select {
+	case <-op.done:
+	default:
+		return true
+	}
+	pendingContainerOp = nil
+	if op.err != nil {
+		report.Errorf(lineno, "COMMAND %s :%v", cmd, op.err)
+	}
+	return false
+}
+
+// startContainerOp runs `f` in the background, as the pending container
+// command.
+func startContainerOp(f func(*Engine) error) {
+	if engine == nil {
+		engine = NewEngine(*engineSocket, *projectName)
+	}
+	op := &containerOp{done: make(chan struct{})}
+	pendingContainerOp = op
+	go func() {
+		op.err = f(engine)
+		close(op.done)
+		wake()
+	}()
+}
+
+// doContainer handles the KILL, REHASH, RESTART and START commands.
+// The script waits until the command finishes, and (except for KILL)
+// until the server's container is ready again.
+// Syntax: `KILL <server> [<signal>]`, `REHASH <server>`,
+// `RESTART <server>` or `START <server>`
+// Returns true if the command should be retried later.
+func doContainer(cmd string, args []string) bool {
+	if pendingContainerOp != nil {
+		return checkContainerOp(cmd)
+	}
+	if len(args) != 1 && !(cmd == "KILL" && len(args) == 2) {
+		report.Errorf(lineno, "COMMAND %s :wrong number of arguments", cmd)
+		return false
+	}
+	server := ReplaceSuffix(args[0])
+	sig := "SIGKILL"
+	if len(args) > 1 {
+		sig = args[1]
+	}
+	startContainerOp(func(e *Engine) error {
+		return e.Lifecycle(cmd, server, sig)
+	})
+	return true
+}
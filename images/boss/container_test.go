@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeEngine implements enough of the container engine API for tests.
+type fakeEngine struct {
+	mu      sync.Mutex
+	running bool
+	calls   []string
+}
+
+func (f *fakeEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/v1.41")
+	switch {
+	case path == "/containers/json":
+		filters := r.URL.Query().Get("filters")
+		// Like an engine that ignores filters, it also lists a
+		// container from another project.
+		other := `{"Id":"def456","Labels":{"com.docker.compose.project":"other",` +
+			`"com.docker.compose.service":"irc-1.example.org"}}`
+		if strings.Contains(filters, "service=irc-1.example.org") &&
+			strings.Contains(filters, "project=simple") {
+			fmt.Fprint(w, `[{"Id":"abc123","Labels":{"com.docker.compose.project":"simple",`+
+				`"com.docker.compose.service":"irc-1.example.org"}},`+other+`]`)
+		} else {
+			fmt.Fprint(w, `[`+other+`]`)
+		}
+	case path == "/containers/abc123/json":
+		json.NewEncoder(w).Encode(map[string]any{
+			"State": map[string]any{"Running": f.running, "Status": "running"},
+		})
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/containers/abc123/"):
+		op := strings.TrimPrefix(path, "/containers/abc123/")
+		if sig := r.URL.Query().Get("signal"); sig != "" {
+			op += " " + sig
+		}
+		f.calls = append(f.calls, op)
+		f.running = op != "kill SIGKILL"
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestEngineLifecycle(t *testing.T) {
+	fake := &fakeEngine{running: true}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	e := &Engine{client: srv.Client(), base: srv.URL + "/v1.41", Project: "simple"}
+
+	steps := []struct {
+		cmd, sig string
+	}{
+		{"KILL", "SIGKILL"},
+		{"START", ""},
+		{"REHASH", ""},
+		{"KILL", "SIGUSR1"},
+		{"RESTART", ""},
+	}
+	for _, step := range steps {
+		if err := e.Lifecycle(step.cmd, "irc-1.example.org", step.sig); err != nil {
+			t.Errorf("%s: %v", step.cmd, err)
+		}
+	}
+	want := "kill SIGKILL,start,kill SIGHUP,kill SIGUSR1,restart"
+	if got := strings.Join(fake.calls, ","); got != want {
+		t.Errorf("calls = %s, want %s", got, want)
+	}
+
+	if err := e.Lifecycle("START", "irc-2.example.org", ""); err == nil {
+		t.Errorf("START of unknown server succeeded")
+	}
+	e.Project = "another"
+	if err := e.Lifecycle("START", "irc-1.example.org", ""); err == nil {
+		t.Errorf("START in another project succeeded")
+	}
+	e.Project = ""
+	if err := e.Lifecycle("START", "irc-1.example.org", ""); err == nil {
+		t.Errorf("START without a project succeeded")
+	}
+	if got := strings.Join(fake.calls, ","); got != want {
+		t.Errorf("calls = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var hostsFile = flag.String("hosts", "/etc/boss/dns.hosts",
+	"File of addresses and names for the DNS server; if it is missing, no DNS server runs")
+
+// DNS record types and response codes that we use.
+const (
+	dnsTypeA    = 1
+	dnsTypePTR  = 12
+	dnsTypeAAAA = 28
+
+	dnsRcodeFormErr  = 1
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotImp   = 4
+)
+
+// dnsTTL is the time-to-live, in seconds, for our answers.
+const dnsTTL = 60
+
+// mismatchAddr4 and mismatchAddr6 are the addresses that forward
+// lookups give for a host in MISMATCH mode.  They are documentation
+// addresses, so they never belong to a real host.
+var mismatchAddr4 = netip.MustParseAddr("192.0.2.1")
+var mismatchAddr6 = netip.MustParseAddr("2001:db8::1")
+
+// DNSHost is a host that the DNS server knows, and how it answers
+// queries about that host.
+type DNSHost struct {
+	// Names lists the host's names; the first is the canonical one.
+	Names []string
+
+	// Addrs lists the host's addresses.
+	Addrs []netip.Addr
+
+	// Mode is one of TIMEOUT, NXDOMAIN, MISMATCH, SPOOF or DELAY, or
+	// empty to answer normally.
+	Mode string
+
+	// Spoof is the name that reverse lookups give in SPOOF mode.
+	Spoof string
+
+	// Delay is how long to wait before answering in DELAY mode.
+	Delay time.Duration
+
+	// SharesWith names another host with one of this host's addresses,
+	// if there is one.  Reverse lookups cannot tell the two apart, so
+	// neither can have a mode.
+	SharesWith string
+}
+
+// DNSServer is a small authoritative DNS server, which answers A, AAAA
+// and PTR queries for the testnet's hosts, and A queries for its DNS
+// blocklist.
+type DNSServer struct {
+	// Conn receives queries and sends replies.
+	Conn net.PacketConn
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// byName maps lower-case names to hosts.
+	byName map[string]*DNSHost
+
+	// byAddr maps addresses to hosts.
+	byAddr map[netip.Addr]*DNSHost
+
+	// listed maps addresses in the DNSBL to their reply codes.
+	listed map[netip.Addr]byte
+}
+
+// dns is the DNS server, if the hosts file exists.
+var dns *DNSServer
+
+// NewDNSServer creates a DNS server for the hosts listed in `r`, which
+// has lines like /etc/hosts: an address followed by names.
+// Each line names one host; if several hosts have an address, the
+// first one answers reverse lookups for it.
+func NewDNSServer(r io.Reader) (*DNSServer, error) {
+	svc := &DNSServer{
+		byName: make(map[string]*DNSHost),
+		byAddr: make(map[netip.Addr]*DNSHost),
+		listed: make(map[netip.Addr]byte),
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("expected an address and names, not %q", line)
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return nil, err
+		}
+
+		// The same names on another line are the same host.
+		host := svc.byName[strings.ToLower(fields[1])]
+		if host == nil {
+			host = &DNSHost{Names: fields[1:]}
+			for _, name := range host.Names {
+				svc.byName[strings.ToLower(name)] = host
+			}
+		}
+		addr = addr.Unmap()
+		host.Addrs = append(host.Addrs, addr)
+		other := svc.byAddr[addr]
+		switch {
+		case other == nil:
+			svc.byAddr[addr] = host
+		case other != host:
+			if host.SharesWith == "" {
+				host.SharesWith = other.Names[0]
+			}
+			if other.SharesWith == "" {
+				other.SharesWith = host.Names[0]
+			}
+		}
+	}
+	return svc, scanner.Err()
+}
+
+// Serve answers queries until `svc.Conn` is closed.
+func (svc *DNSServer) Serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := svc.Conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		reply, delay := svc.Answer(buf[:n])
+		if reply == nil {
+			continue
+		}
+		if delay > 0 {
+			time.AfterFunc(delay, func() { svc.Conn.WriteTo(reply, addr) })
+		} else {
+			svc.Conn.WriteTo(reply, addr)
+		}
+	}
+}
+
+// Close shuts down the server.
+func (svc *DNSServer) Close() error {
+	return svc.Conn.Close()
+}
+
+// dnsQuestion is the question from a DNS query.
+type dnsQuestion struct {
+	// Name is the queried name, without the trailing dot.
+	Name string
+
+	// Type and Class are the query's type and class.
+	Type, Class uint16
+
+	// Raw is the question's wire format.
+	Raw []byte
+}
+
+// parseDNSQuestion parses the first question in the DNS message `msg`.
+func parseDNSQuestion(msg []byte) (q dnsQuestion, err error) {
+	var labels []string
+	pos := 12
+	for {
+		if pos >= len(msg) {
+			return q, errors.New("truncated name")
+		}
+		n := int(msg[pos])
+		pos++
+		if n == 0 {
+			break
+		}
+		if n > 63 || pos+n > len(msg) {
+			return q, errors.New("bad label")
+		}
+		labels = append(labels, string(msg[pos:pos+n]))
+		pos += n
+	}
+	if pos+4 > len(msg) {
+		return q, errors.New("truncated question")
+	}
+	q.Name = strings.Join(labels, ".")
+	q.Type = binary.BigEndian.Uint16(msg[pos:])
+	q.Class = binary.BigEndian.Uint16(msg[pos+2:])
+	q.Raw = msg[12 : pos+4]
+	return q, nil
+}
+
+// appendDNSName appends `name` to `buf` in DNS wire format.
+func appendDNSName(buf []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+	}
+	return append(buf, 0)
+}
+
+// parseReverseName returns the address that the PTR query name `name`
+// is for.
+func parseReverseName(name string) (netip.Addr, bool) {
+	name = strings.ToLower(name)
+	if rest, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		parts := strings.Split(rest, ".")
+		if len(parts) != 4 {
+			return netip.Addr{}, false
+		}
+		parts[0], parts[1], parts[2], parts[3] = parts[3], parts[2], parts[1], parts[0]
+		addr, err := netip.ParseAddr(strings.Join(parts, "."))
+		return addr, err == nil && addr.Is4()
+	}
+	if rest, ok := strings.CutSuffix(name, ".ip6.arpa"); ok {
+		nibbles := strings.Split(rest, ".")
+		if len(nibbles) != 32 {
+			return netip.Addr{}, false
+		}
+		var sb strings.Builder
+		for ii := 31; ii >= 0; ii-- {
+			if len(nibbles[ii]) != 1 {
+				return netip.Addr{}, false
+			}
+			sb.WriteString(nibbles[ii])
+			if ii%4 == 0 && ii > 0 {
+				sb.WriteByte(':')
+			}
+		}
+		addr, err := netip.ParseAddr(sb.String())
+		return addr, err == nil
+	}
+	return netip.Addr{}, false
+}
+
+// dnsReply builds a reply to `query` with `rcode` and `answers`, each of
+// which is the type and data of a record for the question's name.
+func dnsReply(query []byte, q dnsQuestion, rcode int, answers [][]byte) []byte {
+	reply := make([]byte, 12, 512)
+	copy(reply, query[:2])
+	// Set QR and AA, and copy the opcode and RD.
+	reply[2] = 0x84 | query[2]&0x79
+	reply[3] = byte(rcode)
+	qdcount := 0
+	if q.Raw != nil {
+		qdcount = 1
+	}
+	binary.BigEndian.PutUint16(reply[4:], uint16(qdcount))
+	binary.BigEndian.PutUint16(reply[6:], uint16(len(answers)))
+	reply = append(reply, q.Raw...)
+	for _, answer := range answers {
+		// Refer to the question's name, at offset 12.
+		reply = append(reply, 0xc0, 12)
+		reply = append(reply, answer[:2]...)
+		reply = binary.BigEndian.AppendUint16(reply, 1)
+		reply = binary.BigEndian.AppendUint32(reply, dnsTTL)
+		reply = binary.BigEndian.AppendUint16(reply, uint16(len(answer)-2))
+		reply = append(reply, answer[2:]...)
+	}
+	return reply
+}
+
+// dnsRecord returns a record's type and data, as dnsReply() uses.
+func dnsRecord(rtype uint16, data []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, rtype), data...)
+}
+
+// Answer returns the reply to the DNS query `query`, and how long to
+// wait before sending it.  It returns a nil reply if the query should
+// not be answered.
+func (svc *DNSServer) Answer(query []byte) ([]byte, time.Duration) {
+	if len(query) < 12 || query[2]&0x80 != 0 {
+		return nil, 0
+	}
+	if query[2]&0x78 != 0 || binary.BigEndian.Uint16(query[4:]) != 1 {
+		return dnsReply(query, dnsQuestion{}, dnsRcodeNotImp, nil), 0
+	}
+	q, err := parseDNSQuestion(query)
+	if err != nil {
+		return dnsReply(query, dnsQuestion{}, dnsRcodeFormErr, nil), 0
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if addr, ok := parseListedName(q.Name); ok {
+		return svc.answerDNSBL(query, q, addr), 0
+	}
+	var host *DNSHost
+	reverse, isReverse := parseReverseName(q.Name)
+	if isReverse {
+		host = svc.byAddr[reverse.Unmap()]
+	} else {
+		host = svc.byName[strings.ToLower(q.Name)]
+	}
+	if host == nil {
+		return dnsReply(query, q, dnsRcodeNXDomain, nil), 0
+	}
+
+	var delay time.Duration
+	switch host.Mode {
+	case "TIMEOUT":
+		return nil, 0
+	case "DELAY":
+		delay = host.Delay
+	case "NXDOMAIN":
+		if isReverse {
+			return dnsReply(query, q, dnsRcodeNXDomain, nil), 0
+		}
+	}
+
+	var answers [][]byte
+	switch {
+	case isReverse && q.Type == dnsTypePTR:
+		name := host.Names[0]
+		if host.Mode == "SPOOF" {
+			name = host.Spoof
+		}
+		answers = append(answers, dnsRecord(dnsTypePTR, appendDNSName(nil, name)))
+	case !isReverse && q.Type == dnsTypeA:
+		for _, addr := range host.forwardAddrs() {
+			if addr.Is4() {
+				answers = append(answers, dnsRecord(dnsTypeA, addr.AsSlice()))
+			}
+		}
+	case !isReverse && q.Type == dnsTypeAAAA:
+		for _, addr := range host.forwardAddrs() {
+			if addr.Is6() {
+				answers = append(answers, dnsRecord(dnsTypeAAAA, addr.AsSlice()))
+			}
+		}
+	}
+	return dnsReply(query, q, 0, answers), delay
+}
+
+// forwardAddrs returns the addresses that forward lookups give for the
+// host: its own, or in MISMATCH mode, a documentation address in place
+// of each.
+func (host *DNSHost) forwardAddrs() []netip.Addr {
+	if host.Mode != "MISMATCH" {
+		return host.Addrs
+	}
+	addrs := make([]netip.Addr, len(host.Addrs))
+	for ii, addr := range host.Addrs {
+		addrs[ii] = mismatchAddr4
+		if addr.Is6() {
+			addrs[ii] = mismatchAddr6
+		}
+	}
+	return addrs
+}
+
+// SetMode changes how the server answers queries about `name`.
+func (svc *DNSServer) SetMode(name string, mode string, args []string) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	host := svc.byName[strings.ToLower(name)]
+	if host == nil {
+		return errors.New("no DNS records for " + name)
+	}
+	if host.SharesWith != "" {
+		return fmt.Errorf("%s shares an address with %s, so it cannot have its own DNS mode",
+			name, host.SharesWith)
+	}
+
+	nargs := 0
+	switch mode {
+	case "NORMAL", "TIMEOUT", "NXDOMAIN", "MISMATCH":
+	case "SPOOF", "DELAY":
+		nargs = 1
+	default:
+		return errors.New("unknown DNS mode " + mode)
+	}
+	if len(args) != nargs {
+		return fmt.Errorf("wrong number of arguments for %s", mode)
+	}
+
+	switch mode {
+	case "NORMAL":
+		mode = ""
+	case "SPOOF":
+		host.Spoof = args[0]
+	case "DELAY":
+		delay, err := time.ParseDuration(args[0])
+		if err != nil {
+			return err
+		}
+		host.Delay = delay
+	}
+	host.Mode = mode
+	return nil
+}
+
+// doDNS handles the DNS command, which changes how the DNS server
+// answers queries about a client or server.
+// Syntax: `DNS <host> NORMAL|TIMEOUT|NXDOMAIN|MISMATCH`,
+// `DNS <host> SPOOF <name>` or `DNS <host> DELAY <duration>`
+func doDNS(args []string) {
+	if len(args) < 2 {
+		report.Errorf(lineno, "COMMAND DNS :expected DNS <host> <mode>")
+		return
+	}
+	if dns == nil {
+		report.Errorf(lineno, "COMMAND DNS :the DNS server is not running")
+		return
+	}
+	if err := dns.SetMode(ReplaceSuffix(args[0]), args[1], args[2:]); err != nil {
+		report.Errorf(lineno, "COMMAND DNS :%v", err)
+	}
+}
+
+// startDNS starts the DNS server, if the hosts file exists.
+func startDNS() error {
+	f, err := os.Open(*hostsFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	svc, err := NewDNSServer(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", *hostsFile, err)
+	}
+	if svc.Conn, err = net.ListenPacket("udp", ":53"); err != nil {
+		return err
+	}
+	dns = svc
+	go dns.Serve()
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testHosts = `
+# address          names
+10.11.12.3         irc-1.example.org
+fd00:11:12::3      irc-1.example.org
+10.11.12.5         user1.example.org user1
+10.11.12.5         user2.example.org user2
+fd00:11:12::5      user1.example.org user1
+fd00:11:12::5      user2.example.org user2
+10.11.12.6         user3.example.org user3
+`
+
+// startTestDNS starts a DNS server for testHosts, and returns it with a
+// resolver that uses it.
+func startTestDNS(t *testing.T) (*DNSServer, *net.Resolver) {
+	svc, err := NewDNSServer(strings.NewReader(testHosts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svc.Conn, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+		t.Skipf("cannot listen for UDP: %v", err)
+	}
+	go svc.Serve()
+	t.Cleanup(func() { svc.Close() })
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", svc.Conn.LocalAddr().String())
+		},
+	}
+	return svc, resolver
+}
+
+func TestParseReverseName(t *testing.T) {
+	cases := map[string]string{
+		"3.12.11.10.in-addr.arpa": "10.11.12.3",
+		"3.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.2.1.0.0.1.1.0.0.0.0.d.f.IP6.ARPA": "fd00:11:12::3",
+		"12.11.10.in-addr.arpa": "",
+		"irc-1.example.org":     "",
+	}
+	for name, want := range cases {
+		addr, ok := parseReverseName(name)
+		if (want == "" && ok) || (want != "" && (!ok || addr.String() != want)) {
+			t.Errorf("parseReverseName(%s) = %v, %v; want %q", name, addr, ok, want)
+		}
+	}
+}
+
+func TestDNSLookups(t *testing.T) {
+	svc, resolver := startTestDNS(t)
+	ctx := context.Background()
+
+	names, err := resolver.LookupAddr(ctx, "10.11.12.5")
+	if want := []string{"user1.example.org."}; err != nil || !reflect.DeepEqual(names, want) {
+		t.Errorf("LookupAddr(10.11.12.5) = %v, %v; want %v", names, err, want)
+	}
+	names, err = resolver.LookupAddr(ctx, "fd00:11:12::3")
+	if want := []string{"irc-1.example.org."}; err != nil || !reflect.DeepEqual(names, want) {
+		t.Errorf("LookupAddr(fd00:11:12::3) = %v, %v; want %v", names, err, want)
+	}
+	addrs, err := resolver.LookupHost(ctx, "user2.example.org")
+	if want := []string{"10.11.12.5", "fd00:11:12::5"}; err != nil || !sameSet(addrs, want) {
+		t.Errorf("LookupHost(user2.example.org) = %v, %v; want %v", addrs, err, want)
+	}
+	_, err = resolver.LookupHost(ctx, "nobody.example.org")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("LookupHost(nobody.example.org) error = %v; want not found", err)
+	}
+
+	// MISMATCH changes forward lookups.
+	if err = svc.SetMode("user3", "MISMATCH", nil); err != nil {
+		t.Fatal(err)
+	}
+	addrs, err = resolver.LookupHost(ctx, "user3.example.org")
+	if want := []string{"192.0.2.1"}; err != nil || !reflect.DeepEqual(addrs, want) {
+		t.Errorf("mismatched LookupHost = %v, %v; want %v", addrs, err, want)
+	}
+
+	// SPOOF changes reverse lookups.
+	if err = svc.SetMode("user3", "SPOOF", []string{"irc-1.example.org"}); err != nil {
+		t.Fatal(err)
+	}
+	names, err = resolver.LookupAddr(ctx, "10.11.12.6")
+	if want := []string{"irc-1.example.org."}; err != nil || !reflect.DeepEqual(names, want) {
+		t.Errorf("spoofed LookupAddr = %v, %v; want %v", names, err, want)
+	}
+
+	// NXDOMAIN hides reverse records only.
+	if err = svc.SetMode("user3", "NXDOMAIN", nil); err != nil {
+		t.Fatal(err)
+	}
+	if names, err = resolver.LookupAddr(ctx, "10.11.12.6"); err == nil {
+		t.Errorf("LookupAddr in NXDOMAIN mode = %v", names)
+	}
+	if addrs, err = resolver.LookupHost(ctx, "user3.example.org"); err != nil {
+		t.Errorf("LookupHost in NXDOMAIN mode = %v, %v", addrs, err)
+	}
+
+	// TIMEOUT never answers.
+	if err = svc.SetMode("user3", "TIMEOUT", nil); err != nil {
+		t.Fatal(err)
+	}
+	shortCtx, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancel()
+	if names, err = resolver.LookupAddr(shortCtx, "10.11.12.6"); err == nil {
+		t.Errorf("LookupAddr in TIMEOUT mode = %v", names)
+	}
+
+	// DELAY answers late.
+	if err = svc.SetMode("user3", "DELAY", []string{"200ms"}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if names, err = resolver.LookupAddr(ctx, "10.11.12.6"); err != nil {
+		t.Errorf("LookupAddr in DELAY mode = %v, %v", names, err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("delayed lookup took %v", elapsed)
+	}
+
+	if err = svc.SetMode("nobody", "NORMAL", nil); err == nil {
+		t.Errorf("SetMode(nobody) succeeded")
+	}
+	if err = svc.SetMode("user3", "SPOOF", nil); err == nil {
+		t.Errorf("SetMode(SPOOF) without a name succeeded")
+	}
+}
+
+func TestDNSSharedAddress(t *testing.T) {
+	svc, resolver := startTestDNS(t)
+	ctx := context.Background()
+
+	// user1 and user2 run on one host, so a mode for either would change
+	// the answers for both.
+	for _, name := range []string{"user1", "user2.example.org"} {
+		if err := svc.SetMode(name, "MISMATCH", nil); err == nil {
+			t.Errorf("SetMode(%s) succeeded for a shared address", name)
+		}
+	}
+	addrs, err := resolver.LookupHost(ctx, "user1.example.org")
+	if want := []string{"10.11.12.5", "fd00:11:12::5"}; err != nil || !sameSet(addrs, want) {
+		t.Errorf("LookupHost(user1.example.org) = %v, %v; want %v", addrs, err, want)
+	}
+	addrs, err = resolver.LookupHost(ctx, "user2.example.org")
+	if want := []string{"10.11.12.5", "fd00:11:12::5"}; err != nil || !sameSet(addrs, want) {
+		t.Errorf("LookupHost(user2.example.org) = %v, %v; want %v", addrs, err, want)
+	}
+
+	// doDNS reports the rejection.
+	oldDNS := dns
+	t.Cleanup(func() { dns = oldDNS })
+	dns = svc
+	nResults := len(report.Results())
+	doDNS([]string{"user2", "TIMEOUT"})
+	if results := report.Results()[nResults:]; len(results) != 1 || results[0].Outcome != Errored {
+		t.Errorf("DNS user2 TIMEOUT gave results %+v", results)
+	}
+
+	// A client with its own address can still have a mode.
+	if err := svc.SetMode("user3", "MISMATCH", nil); err != nil {
+		t.Errorf("SetMode(user3) = %v", err)
+	}
+}
+
+// sameSet returns true if `a` and `b` have the same elements.
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]int)
+	for _, s := range a {
+		seen[s]++
+	}
+	for _, s := range b {
+		seen[s]--
+	}
+	for _, n := range seen {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
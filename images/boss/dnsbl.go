@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// dnsblZone is the DNS zone that the DNS server answers as a DNS
+// blocklist.
+const dnsblZone = "dnsbl.testnet"
+
+// parseListedName returns the address that the DNSBL query name `name`
+// is for: the address's octets (or nibbles) in reverse order, followed
+// by dnsblZone.
+func parseListedName(name string) (netip.Addr, bool) {
+	rest, ok := strings.CutSuffix(strings.ToLower(name), "."+dnsblZone)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	if addr, ok := parseReverseName(rest + ".in-addr.arpa"); ok {
+		return addr, true
+	}
+	return parseReverseName(rest + ".ip6.arpa")
+}
+
+// answerDNSBL returns the reply to the DNSBL query `query` for `addr`:
+// 127.0.0.<code> if the address is listed, or NXDOMAIN if it is not.
+// `svc.mu` must be locked.
+func (svc *DNSServer) answerDNSBL(query []byte, q dnsQuestion, addr netip.Addr) []byte {
+	code, ok := svc.listed[addr.Unmap()]
+	if !ok {
+		return dnsReply(query, q, dnsRcodeNXDomain, nil)
+	}
+	var answers [][]byte
+	if q.Type == dnsTypeA {
+		answers = append(answers, dnsRecord(dnsTypeA, []byte{127, 0, 0, code}))
+	}
+	return dnsReply(query, q, 0, answers)
+}
+
+// List adds the addresses of `name` to the DNSBL with the reply code
+// `code`, or removes them if `code` is zero.
+func (svc *DNSServer) List(name string, code byte) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	host := svc.byName[strings.ToLower(name)]
+	if host == nil {
+		return errors.New("no DNS records for " + name)
+	}
+	for _, addr := range host.Addrs {
+		if code == 0 {
+			delete(svc.listed, addr)
+		} else {
+			svc.listed[addr] = code
+		}
+	}
+	return nil
+}
+
+// doDNSBL handles the DNSBL command, which lists or unlists a client's
+// addresses in the DNS blocklist.
+// Syntax: `DNSBL LIST <client> <code>` or `DNSBL UNLIST <client>`
+func doDNSBL(args []string) {
+	if dns == nil {
+		report.Errorf(lineno, "COMMAND DNSBL :the DNS server is not running")
+		return
+	}
+
+	var code uint64
+	switch {
+	case len(args) == 3 && args[0] == "LIST":
+		var err error
+		code, err = strconv.ParseUint(args[2], 10, 8)
+		if err != nil || code == 0 {
+			report.Errorf(lineno, "COMMAND DNSBL :invalid code %q (expected 1 to 255)", args[2])
+			return
+		}
+	case len(args) == 2 && args[0] == "UNLIST":
+	default:
+		report.Errorf(lineno, "COMMAND DNSBL :expected DNSBL LIST <client> <code> or DNSBL UNLIST <client>")
+		return
+	}
+	if err := dns.List(args[1], byte(code)); err != nil {
+		report.Errorf(lineno, "COMMAND DNSBL :%v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestParseListedName(t *testing.T) {
+	cases := map[string]string{
+		"5.12.11.10.dnsbl.testnet": "10.11.12.5",
+		"5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.2.1.0.0.1.1.0.0.0.0.d.f.DNSBL.testnet": "fd00:11:12::5",
+		"5.12.11.10.in-addr.arpa": "",
+		"12.11.10.dnsbl.testnet":  "",
+	}
+	for name, want := range cases {
+		addr, ok := parseListedName(name)
+		if (want == "" && ok) || (want != "" && (!ok || addr.String() != want)) {
+			t.Errorf("parseListedName(%s) = %v, %v; want %q", name, addr, ok, want)
+		}
+	}
+}
+
+func TestDNSBL(t *testing.T) {
+	svc, resolver := startTestDNS(t)
+	ctx := context.Background()
+	user1v4 := "5.12.11.10.dnsbl.testnet"
+	user1v6 := "5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.2.1.0.0.1.1.0.0.0.0.d.f.dnsbl.testnet"
+	user3 := "6.12.11.10.dnsbl.testnet"
+
+	if err := svc.List("user1", 2); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{user1v4, user1v6} {
+		addrs, err := resolver.LookupHost(ctx, name)
+		if want := []string{"127.0.0.2"}; err != nil || !reflect.DeepEqual(addrs, want) {
+			t.Errorf("LookupHost(%s) = %v, %v; want %v", name, addrs, err, want)
+		}
+	}
+	if addrs, err := resolver.LookupHost(ctx, user3); err == nil {
+		t.Errorf("LookupHost for unlisted client = %v", addrs)
+	}
+
+	if err := svc.List("user1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if addrs, err := resolver.LookupHost(ctx, user1v4); err == nil {
+		t.Errorf("LookupHost for unlisted client = %v", addrs)
+	}
+
+	if err := svc.List("nobody", 2); err == nil {
+		t.Errorf("List(nobody) succeeded")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Match is one pattern within an Expectation.
+type Match struct {
+	// Pattern describes what we want to match.
+	Pattern *regexp.Regexp
+
+	// Count is how many more lines must match `Pattern`.
+	Count int
+}
+
+// String describes `m` in script syntax.
+func (m *Match) String() string {
+	if m.Count == 1 {
+		return m.Pattern.String()
+	}
+	return fmt.Sprintf("%d :%s", m.Count, m.Pattern)
+}
+
+// Expectation records one or more expected lines from a server.
+//
+// A plain expectation has a single Match.
+// A negative expectation, from `EXPECT-NOT`, fails if its Match is seen
+// before its deadline.
+// Expectations from `EXPECT ALL` are satisfied once every Match has
+// been seen (in any order) as many times as it requires, and those from
+// `EXPECT ANY` are satisfied by the first line that matches any Match.
+type Expectation struct {
+	// Matches lists the patterns that are still needed.
+	Matches []*Match
+
+	// Any is true if matching any pattern satisfies the expectation.
+	Any bool
+
+	// Negate is true if the expectation is that no line matches.
+	Negate bool
+
+	// Text describes the expectation for reports.
+	Text string
+
+	// Deadline is the time at which we give up on the expectation.
+	Deadline time.Time
+
+	// Fatal is true if a failed expectation should stop the script.
+	Fatal bool
+
+	// File names the included file that created the expectation, or is
+	// empty for the main script.
+	File string
+
+	// Line is the script line number that created the expectation.
+	Line int
+
+	// Start is when the expectation was created.
+	Start time.Time
+
+	// Client is the client that expects the line.
+	Client *ClientConn
+
+	// timer delivers the expectation to `timeoutChan` at `Deadline`.
+	timer *time.Timer
+}
+
+// Accept checks `text` against the expectation's patterns.
+// Named subexpressions of a matching pattern are saved in the client's
+// variables.
+// Returns true if the expectation is now satisfied.
+func (exp *Expectation) Accept(text string) bool {
+	for idx, match := range exp.Matches {
+		m := match.Pattern.FindStringSubmatch(text)
+		if m == nil {
+			continue
+		}
+
+		// Save any named subexpressions.
+		for jj, name := range match.Pattern.SubexpNames() {
+			if name != "" {
+				exp.Client.vars[name] = m[jj]
+			}
+		}
+
+		// Is that the last line we need for this pattern?
+		if match.Count--; match.Count > 0 {
+			return false
+		} else if exp.Any {
+			return true
+		}
+		n := copy(exp.Matches[idx:], exp.Matches[idx+1:])
+		exp.Matches[idx+n] = nil
+		exp.Matches = exp.Matches[:idx+n]
+		return len(exp.Matches) == 0
+	}
+
+	return false
+}
+
+// Hits returns true if `text` matches any of the expectation's
+// patterns, without changing the expectation.
+func (exp *Expectation) Hits(text string) bool {
+	for _, match := range exp.Matches {
+		if match.Pattern.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// Result creates a report entry for the expectation.
+func (exp *Expectation) Result(outcome Outcome, message string) Result {
+	command := "EXPECT"
+	if exp.Negate {
+		command = "EXPECT-NOT"
+	}
+	return Result{
+		File:     exp.File,
+		Line:     exp.Line,
+		Command:  command,
+		Client:   exp.Client.Name,
+		Text:     exp.Text,
+		Outcome:  outcome,
+		Duration: time.Since(exp.Start),
+		Message:  message,
+	}
+}
+
+// Where describes the script line that created the expectation, as
+// "line <n>" or "<file>:<n>" for a line of an included file.
+func (exp *Expectation) Where() string {
+	if exp.File != "" {
+		return fmt.Sprintf("%s:%d", exp.File, exp.Line)
+	}
+	return fmt.Sprintf("line %d", exp.Line)
+}
+
+// Remaining describes the patterns that are still needed.
+func (exp *Expectation) Remaining() string {
+	if len(exp.Matches) == 1 {
+		return exp.Matches[0].String()
+	}
+
+	parts := make([]string, len(exp.Matches))
+	for idx, match := range exp.Matches {
+		parts[idx] = match.String()
+	}
+	mode := "ALL"
+	if exp.Any {
+		mode = "ANY"
+	}
+	return mode + " {" + strings.Join(parts, "; ") + "}"
+}
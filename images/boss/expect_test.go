@@ -0,0 +1,252 @@
+package main
+
+import (
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestClient creates a client that is not connected, and adds it to
+// `clients` until the test ends.
+func newTestClient(t *testing.T, name string) *ClientConn {
+	client := &ClientConn{
+		Name:           name,
+		Nickname:       name,
+		registeredCond: sync.NewCond(&sync.Mutex{}),
+		vars:           make(map[string]string),
+	}
+	oldClients := clients
+	clients = map[string]*ClientConn{name: client}
+	for other, c := range oldClients {
+		if other != name {
+			clients[other] = c
+		}
+	}
+	t.Cleanup(func() { clients = oldClients })
+	return client
+}
+
+// newTestExpectation creates an expectation for `client` with a Match
+// for each pattern, which needs the matching count from `counts`.
+func newTestExpectation(client *ClientConn, any bool, patterns []string, counts []int) *Expectation {
+	exp := &Expectation{Client: client, Any: any}
+	for ii, pattern := range patterns {
+		exp.Matches = append(exp.Matches, &Match{
+			Pattern: regexp.MustCompile(pattern),
+			Count:   counts[ii],
+		})
+	}
+	return exp
+}
+
+func TestExpectationAccept(t *testing.T) {
+	client := newTestClient(t, "user1")
+	cases := []struct {
+		name     string
+		any      bool
+		patterns []string
+		counts   []int
+		lines    []string
+		// done gives, for each line, whether the expectation is
+		// satisfied after it.
+		done []bool
+	}{
+		{"single", false, []string{"JOIN"}, []int{1},
+			[]string{"PRIVMSG", "JOIN #a"}, []bool{false, true}},
+		{"count", false, []string{"JOIN"}, []int{3},
+			[]string{"JOIN #a", "PART #a", "JOIN #b", "JOIN #c"},
+			[]bool{false, false, false, true}},
+		{"all in order", false, []string{"JOIN", "MODE"}, []int{1, 1},
+			[]string{"JOIN #a", "MODE #a"}, []bool{false, true}},
+		{"all out of order", false, []string{"JOIN", "MODE"}, []int{1, 1},
+			[]string{"MODE #a", "JOIN #a"}, []bool{false, true}},
+		{"all with counts", false, []string{"JOIN", "MODE"}, []int{2, 1},
+			[]string{"JOIN #a", "MODE #a", "MODE #b", "JOIN #b"},
+			[]bool{false, false, false, true}},
+		{"all repeated pattern", false, []string{"JOIN", "MODE"}, []int{1, 1},
+			[]string{"JOIN #a", "JOIN #b", "MODE #a"}, []bool{false, false, true}},
+		{"any", true, []string{"KICK", "PART"}, []int{1, 1},
+			[]string{"JOIN #a", "PART #a"}, []bool{false, true}},
+		{"any with counts", true, []string{"KICK", "PART"}, []int{2, 1},
+			[]string{"KICK #a", "KICK #b"}, []bool{false, true}},
+	}
+	for _, c := range cases {
+		exp := newTestExpectation(client, c.any, c.patterns, c.counts)
+		for ii, line := range c.lines {
+			if got := exp.Accept(line); got != c.done[ii] {
+				t.Errorf("%s: Accept(%q) = %v, want %v", c.name, line, got, c.done[ii])
+			}
+		}
+	}
+}
+
+func TestExpectationCapture(t *testing.T) {
+	client := newTestClient(t, "user1")
+	exp := newTestExpectation(client, false, []string{`JOIN (?P<chan>#\S+)`}, []int{1})
+	if !exp.Accept(":user1!u@h JOIN #test") {
+		t.Fatalf("Accept did not match")
+	}
+	if got := client.vars["chan"]; got != "#test" {
+		t.Errorf("captured chan = %q, want #test", got)
+	}
+}
+
+func TestExpectationHits(t *testing.T) {
+	client := newTestClient(t, "user1")
+	exp := newTestExpectation(client, false, []string{"KILL"}, []int{1})
+	exp.Negate = true
+	cases := []struct {
+		line string
+		hits bool
+	}{
+		{"PRIVMSG #a :hi", false},
+		{":irc-1 KILL user1 :bye", true},
+		{":irc-1 KILL user1 :again", true},
+	}
+	for _, c := range cases {
+		if got := exp.Hits(c.line); got != c.hits {
+			t.Errorf("Hits(%q) = %v, want %v", c.line, got, c.hits)
+		}
+	}
+	// Hits does not use up the pattern.
+	if len(exp.Matches) != 1 || exp.Matches[0].Count != 1 {
+		t.Errorf("Hits changed the expectation: %s", exp.Remaining())
+	}
+}
+
+func TestHandleRejection(t *testing.T) {
+	cases := []struct {
+		name    string
+		fatal   bool
+		line    string
+		ok      bool
+		outcome Outcome
+	}{
+		{"no match", false, ":irc-1 NOTICE user1 :hi", true, Outcome(-1)},
+		{"warning", false, ":irc-1 KILL user1 :bye", true, Unexpected},
+		{"fatal", true, ":irc-1 KILL user1 :bye", false, Fatal},
+	}
+	for _, c := range cases {
+		client := newTestClient(t, "user1")
+		client.Server = "irc-1.example.org:6667"
+		exp := newTestExpectation(client, false, []string{"KILL"}, []int{1})
+		exp.Negate, exp.Fatal = true, c.fatal
+		exp.timer = time.AfterFunc(time.Hour, func() {})
+		client.Reject = append(client.Reject, exp)
+
+		nResults := len(report.Results())
+		tl := &TextLine{Source: client, Text: c.line}
+		if got := tl.Handle(); got != c.ok {
+			t.Errorf("%s: Handle() = %v, want %v", c.name, got, c.ok)
+		}
+		results := report.Results()[nResults:]
+		if c.outcome < 0 {
+			if len(results) != 0 || len(client.Reject) != 1 {
+				t.Errorf("%s: results %+v, %d rejections left", c.name, results, len(client.Reject))
+			}
+			continue
+		}
+		if len(results) != 1 || results[0].Outcome != c.outcome ||
+			results[0].Command != "EXPECT-NOT" || len(client.Reject) != 0 {
+			t.Errorf("%s: results %+v, %d rejections left", c.name, results, len(client.Reject))
+		}
+	}
+}
+
+func TestExpectationRemaining(t *testing.T) {
+	client := newTestClient(t, "user1")
+	cases := []struct {
+		any      bool
+		patterns []string
+		counts   []int
+		want     string
+	}{
+		{false, []string{"JOIN"}, []int{1}, "JOIN"},
+		{false, []string{"JOIN"}, []int{3}, "3 :JOIN"},
+		{false, []string{"JOIN", "MODE"}, []int{2, 1}, "ALL {2 :JOIN; MODE}"},
+		{true, []string{"KICK", "PART"}, []int{1, 1}, "ANY {KICK; PART}"},
+	}
+	for _, c := range cases {
+		exp := newTestExpectation(client, c.any, c.patterns, c.counts)
+		if got := exp.Remaining(); got != c.want {
+			t.Errorf("Remaining() = %q, want %q", got, c.want)
+		}
+	}
+}
+
+func TestExpectationWhere(t *testing.T) {
+	cases := []struct {
+		file string
+		line int
+		want string
+	}{
+		{"", 12, "line 12"},
+		{"common.script", 3, "common.script:3"},
+	}
+	for _, c := range cases {
+		exp := &Expectation{File: c.file, Line: c.line}
+		if got := exp.Where(); got != c.want {
+			t.Errorf("Where() = %q, want %q", got, c.want)
+		}
+	}
+}
+
+func TestExpireExpectation(t *testing.T) {
+	cases := []struct {
+		name    string
+		cmd     string
+		target  string
+		file    string
+		line    int
+		ok      bool
+		outcome Outcome
+	}{
+		{"timeout", "EXPECT", "user1@50ms", "", 7, true, TimedOut},
+		{"included timeout", "EXPECT", "user1@50ms", "common.script", 3, true, TimedOut},
+		{"fatal", "EXPECT", "!user1@50ms", "common.script", 4, false, Fatal},
+		{"absent", "EXPECT-NOT", "user1@50ms", "", 9, true, Absent},
+	}
+	oldFile, oldLine := linefile, lineno
+	t.Cleanup(func() { linefile, lineno = oldFile, oldLine })
+	for _, c := range cases {
+		client := newTestClient(t, "user1")
+		linefile, lineno = c.file, c.line
+		if c.cmd == "EXPECT" {
+			doExpect([]string{c.target, "never"})
+		} else {
+			doExpectNot([]string{c.target, "never"})
+		}
+		if !client.Pending() {
+			t.Fatalf("%s: no expectation was armed", c.name)
+		}
+
+		var exp *Expectation
+		select {
+		case exp = <-timeoutChan:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: expectation did not time out", c.name)
+		}
+		nResults := len(report.Results())
+		if got := expireExpectation(exp); got != c.ok {
+			t.Errorf("%s: expireExpectation() = %v, want %v", c.name, got, c.ok)
+		}
+		results := report.Results()[nResults:]
+		if len(results) != 1 {
+			t.Fatalf("%s: got results %+v", c.name, results)
+		}
+		res := results[0]
+		if res.Outcome != c.outcome || res.File != c.file || res.Line != c.line ||
+			res.Command != c.cmd || res.Client != "user1" || res.Text != "never" {
+			t.Errorf("%s: result = %+v", c.name, res)
+		}
+		if client.Pending() {
+			t.Errorf("%s: expired expectation is still pending", c.name)
+		}
+
+		// Once it is resolved, a late timer does nothing.
+		if !expireExpectation(exp) || len(report.Results()) != nResults+1 {
+			t.Errorf("%s: expiring it again changed the report", c.name)
+		}
+	}
+}
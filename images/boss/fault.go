@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// faultControlPort is the port that fault proxies (from
+// images/faultproxy) accept control connections on.
+const faultControlPort = "7000"
+
+// dialFault connects to the control port of the fault proxy `proxy`.
+// Tests replace it.
+var dialFault = func(proxy string) (net.Conn, error) {
+	return net.DialTimeout("tcp", net.JoinHostPort(proxy, faultControlPort),
+		5*time.Second)
+}
+
+// faultCommand sends the control command `line` to the fault proxy
+// `proxy`, and returns its reply, or an error if the command failed.
+func faultCommand(proxy, line string) (string, error) {
+	conn, err := dialFault(proxy)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reply := ""
+	if _, err = fmt.Fprintf(conn, "%s\r\n", line); err == nil {
+		reply, err = bufio.NewReader(conn).ReadString('\n')
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", proxy, err)
+	}
+	reply = strings.TrimRight(reply, "\r\n")
+	if !strings.HasPrefix(reply, "OK") {
+		return "", errors.New(proxy + ": " + reply)
+	}
+	return reply, nil
+}
+
+// doFault handles the FAULT command, which sends a control command to a
+// fault proxy.
+// Syntax: `FAULT <proxy> <setting> ...`, `FAULT <proxy> CLEAR` or
+// `FAULT <proxy> RESET`
+func doFault(args []string) {
+	if len(args) < 2 {
+		report.Errorf(lineno, "COMMAND FAULT :expected FAULT <proxy> <command>")
+		return
+	}
+	_, err := faultCommand(ReplaceSuffix(args[0]), strings.Join(args[1:], " "))
+	if err != nil {
+		report.Errorf(lineno, "COMMAND FAULT :%v", err)
+	}
+}
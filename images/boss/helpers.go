@@ -4,9 +4,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Suffix is the hostname suffix for this Compose application.
@@ -21,6 +25,187 @@ func ReplaceSuffix(name string) string {
 	return name
 }
 
+// ExpandMode selects how ExpandVars() inserts variable values.
+type ExpandMode int
+
+const (
+	// ExpandText inserts variable values verbatim.
+	ExpandText ExpandMode = iota
+
+	// ExpandRegexp quotes variable values with regexp.QuoteMeta, so
+	// they match literally when the result is used as a regexp.
+	ExpandRegexp
+)
+
+// ExpandVars replaces `${name}` references in `text` with values from
+// `lookup`, inserting them as `mode` specifies.
+// A reference written as `${=name}` is always inserted verbatim, so a
+// variable can hold part of a regexp.
+// If `lookup` fails, ExpandVars returns the first error.
+func ExpandVars(text string, mode ExpandMode, lookup func(string) (string, error)) (string, error) {
+	var firstErr error
+	result := os.Expand(text, func(name string) string {
+		raw := mode == ExpandText
+		if strings.HasPrefix(name, "=") {
+			raw = true
+			name = name[1:]
+		}
+
+		value, err := lookup(name)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if !raw {
+			value = regexp.QuoteMeta(value)
+		}
+		return value
+	})
+	return result, firstErr
+}
+
+// caseMappings maps CASEMAPPING names to the highest character that is
+// folded from upper to lower case.
+var caseMappings = map[string]byte{
+	"ascii":          'Z',
+	"rfc1459":        '^',
+	"strict-rfc1459": ']',
+}
+
+// ircCaseLimit returns the highest upper-case character for `mapping`.
+func ircCaseLimit(mapping string) byte {
+	if limit, ok := caseMappings[mapping]; ok {
+		return limit
+	}
+	return '^'
+}
+
+// IrcToLower lower-cases `s` using the IRC case mapping `mapping`.
+// Under "rfc1459", the characters `[\]^` are the upper-case forms of
+// `{|}~`; under "strict-rfc1459", `^` and `~` are distinct; under
+// "ascii", only the letters A to Z are folded.
+func IrcToLower(s string, mapping string) string {
+	limit := ircCaseLimit(mapping)
+	return strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= rune(limit) {
+			return r + 32
+		}
+		return r
+	}, s)
+}
+
+// IrcToUpper upper-cases `s` using the IRC case mapping `mapping`.
+// See IrcToLower() for the supported mappings.
+func IrcToUpper(s string, mapping string) string {
+	limit := ircCaseLimit(mapping) + 32
+	return strings.Map(func(r rune) rune {
+		if 'a' <= r && r <= rune(limit) {
+			return r - 32
+		}
+		return r
+	}, s)
+}
+
+// EvalInt evaluates an integer expression using the operators `+`,
+// `-`, `*`, `/` and `%`, unary `-`, and parentheses.
+func EvalInt(expr string) (int64, error) {
+	p := exprParser{text: expr}
+	value, err := p.sum()
+	if err == nil && p.peek() != 0 {
+		err = fmt.Errorf("unexpected %q in %q", p.text[p.pos:], expr)
+	}
+	return value, err
+}
+
+// exprParser is a recursive-descent parser for EvalInt().
+type exprParser struct {
+	text string
+	pos  int
+}
+
+// peek skips whitespace and returns the next byte, or 0 at the end.
+func (p *exprParser) peek() byte {
+	for p.pos < len(p.text) && (p.text[p.pos] == ' ' || p.text[p.pos] == '\t') {
+		p.pos++
+	}
+	if p.pos == len(p.text) {
+		return 0
+	}
+	return p.text[p.pos]
+}
+
+// sum parses `product (('+' | '-') product)*`.
+func (p *exprParser) sum() (int64, error) {
+	lhs, err := p.product()
+	for err == nil {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			break
+		}
+		p.pos++
+		var rhs int64
+		if rhs, err = p.product(); op == '+' {
+			lhs += rhs
+		} else {
+			lhs -= rhs
+		}
+	}
+	return lhs, err
+}
+
+// product parses `unary (('*' | '/' | '%') unary)*`.
+func (p *exprParser) product() (int64, error) {
+	lhs, err := p.unary()
+	for err == nil {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			break
+		}
+		p.pos++
+		var rhs int64
+		if rhs, err = p.unary(); err != nil {
+			break
+		}
+		switch {
+		case op == '*':
+			lhs *= rhs
+		case rhs == 0:
+			err = errors.New("division by zero")
+		case op == '/':
+			lhs /= rhs
+		default:
+			lhs %= rhs
+		}
+	}
+	return lhs, err
+}
+
+// unary parses `'-' unary | '(' sum ')' | <integer>`.
+func (p *exprParser) unary() (int64, error) {
+	switch p.peek() {
+	case '-':
+		p.pos++
+		value, err := p.unary()
+		return -value, err
+	case '(':
+		p.pos++
+		value, err := p.sum()
+		if err == nil && p.peek() != ')' {
+			err = fmt.Errorf("missing ) in %q", p.text)
+		}
+		p.pos++
+		return value, err
+	}
+
+	start := p.pos
+	for p.pos < len(p.text) && '0' <= p.text[p.pos] && p.text[p.pos] <= '9' {
+		p.pos++
+	}
+	if start == p.pos {
+		return 0, fmt.Errorf("expected a number at %q in %q", p.text[start:], p.text)
+	}
+	return strconv.ParseInt(p.text[start:p.pos], 10, 64)
+}
+
 // IsClosedConnError returns true if err is an error that is typically
 // returned when using a closed network connection.
 func IsClosedConnError(err error) bool {
@@ -34,13 +219,31 @@ func IrcTrim(line string) string {
 	return line
 }
 
-// appendSplit splits `line` in an IRC-like fashion and appends its
-// tokens to `parts`.
+// ScriptSplitLine splits a script line in an IRC-like fashion.
 //
-// The first token is interpreted as a command and appended as-is.
-// Following tokens are delimited by spaces, but a token starting with
-// ':' means the rest of the line is a single (line-final) token.
-func appendSplit(parts []string, line string) []string {
+// The first token is the command.  Following tokens are delimited by
+// spaces, but a token starting with ':' means the rest of the line is a
+// single (line-final) token.
+//
+// Blank lines and lines starting with '#' (comments) return nil.
+// Lines starting with ':<name> <text>' are translated to "SEND",
+// "<name>", "<text>".
+func ScriptSplitLine(line string) []string {
+	// Ignore blank lines and comments.
+	if line = IrcTrim(line); len(line) == 0 || line[0] == '#' {
+		return nil
+	}
+
+	// Is this a SEND-type line?
+	if line[0] == ':' {
+		name, rest, found := strings.Cut(line, " ")
+		if !found {
+			panic("Invalid script syntax " + line)
+		}
+		return []string{"SEND", name[1:], rest}
+	}
+
+	parts := make([]string, 0, 4)
 	for ii, ll, first := 0, len(line), true; ii < ll; first = false {
 		// Skip leading whitespace.
 		for ; ii < ll && line[ii] == ' '; ii++ {
@@ -63,60 +266,24 @@ func appendSplit(parts []string, line string) []string {
 	return parts
 }
 
-// ScriptSplitLine works like IrcSplitLine except that:
-//   - Lines starting with '#' return nil, as comments.
-//   - Lines starting with ':<name> <text>' are translated to
-//     "SEND", "<name>", "<text>".
-func ScriptSplitLine(line string) []string {
-	// Ignore blank lines and comments.
-	if line = IrcTrim(line); len(line) == 0 || line[0] == '#' {
-		return nil
-	}
-
-	// Is this a SEND-type line?
-	if line[0] == ':' {
-		name, rest, found := strings.Cut(line, " ")
-		if !found {
-			panic("Invalid script syntax " + line)
+// ParseTimeout parses a timeout given as either a Go duration (such as
+// "500ms" or "1m30s") or a plain number of seconds (such as "2.5").
+func ParseTimeout(text string) (time.Duration, error) {
+	if d, err := time.ParseDuration(text); err == nil {
+		if d < 0 {
+			return 0, fmt.Errorf("negative duration %s", text)
 		}
-		return []string{"SEND", name[1:], rest}
+		return d, nil
 	}
 
-	return appendSplit(make([]string, 0, 4), line)
-}
-
-// IrcSplitLine splits `line` in an IRC-client-like fashion.
-//
-// The returned slice is nil if the line is blank.
-// Otherwise, the slice contains the source and command names, followed
-// by any arguments in the line.
-//
-// If the line starts with ':', then the rest of the first token is the
-// source name and the command name is the second token; otherwise, the
-// source name is "" and the command name is the first token.
-func IrcSplitLine(line string) []string {
-	// Ignore blank lines.
-	if line = IrcTrim(line); len(line) == 0 {
-		return nil
+	sec, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return 0, err
 	}
-
-	// Allocate a slice.
-	parts := make([]string, 1, 7)
-
-	// Does this have a prefix?
-	if line[0] == ':' {
-		ii, ll := 1, len(line)
-		for ; ii < ll && line[ii] != ' '; ii++ {
-		}
-		if ii == ll {
-			fmt.Printf("Bogus IRC line %v\n", line)
-			return nil
-		}
-		parts[0] = line[1:ii]
-		line = line[ii+1:]
-	} // else parts[0] is already ""
-
-	return appendSplit(parts, line)
+	if sec < 0 || math.IsNaN(sec) || math.IsInf(sec, 0) {
+		return 0, fmt.Errorf("invalid duration %s", text)
+	}
+	return time.Duration(math.Round(1e9 * sec)), nil
 }
 
 // SplitAddress splits the host address and port out of a network address.
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"errors"
+	"regexp"
 	"testing"
+	"time"
 )
 
 func TestSplitLineEmpty(t *testing.T) {
@@ -41,22 +44,6 @@ func TestSplitLineLabeled(t *testing.T) {
 	}
 }
 
-func TestSplitLineSourced(t *testing.T) {
-	argv := IrcSplitLine(":Joe SCHMOE :world\r\n")
-	if len(argv) != 3 || argv[0] != "Joe" || argv[1] != "SCHMOE" || argv[2] != "world" {
-		t.Errorf(`IrcSplitLine(":Joe SCHMOE :world\r\n") = %v; want `+
-			`{ "Joe", "SCHMOE", "world" }`, argv)
-	}
-}
-
-func TestSplitLineIRC(t *testing.T) {
-	argv := IrcSplitLine("HELLO :world\r\n")
-	if len(argv) != 3 || argv[0] != "" || argv[1] != "HELLO" || argv[2] != "world" {
-		t.Errorf(`IrcSplitLine("HELLO :world\r\n") = %v; want `+
-			`{ "", "HELLO", "world" }`, argv)
-	}
-}
-
 func TestSplitLinePlain(t *testing.T) {
 	argv := ScriptSplitLine("SEND Joe SCHMOE\n")
 	if len(argv) != 3 || argv[0] != "SEND" || argv[1] != "Joe" || argv[2] != "SCHMOE" {
@@ -99,3 +86,262 @@ func TestSplitAddress(t *testing.T) {
 		}
 	}
 }
+
+var timeoutTests = []struct {
+	Text     string
+	Duration time.Duration
+	OK       bool
+}{
+	{"10s", 10 * time.Second, true},
+	{"500ms", 500 * time.Millisecond, true},
+	{"1m30s", 90 * time.Second, true},
+	{"2", 2 * time.Second, true},
+	{"0.25", 250 * time.Millisecond, true},
+	{"-1s", 0, false},
+	{"-3", 0, false},
+	{"soon", 0, false},
+	{"", 0, false},
+}
+
+func TestParseTimeout(t *testing.T) {
+	for _, ref := range timeoutTests {
+		d, err := ParseTimeout(ref.Text)
+		if (err == nil) != ref.OK || d != ref.Duration {
+			t.Errorf("ParseTimeout(%q) = %v, %v; want %v, ok=%v",
+				ref.Text, d, err, ref.Duration, ref.OK)
+		}
+	}
+}
+
+var expandVars = map[string]string{
+	"me":      "a|b",
+	"channel": "#c++",
+	"any":     ".*",
+	"plain":   "joe",
+}
+
+var expandTests = []struct {
+	Text   string
+	Mode   ExpandMode
+	Result string
+	OK     bool
+}{
+	{"${me}", ExpandText, "a|b", true},
+	{"${me}", ExpandRegexp, `a\|b`, true},
+	{"${=me}", ExpandRegexp, "a|b", true},
+	{"${=me}", ExpandText, "a|b", true},
+	{"JOIN ${channel}", ExpandText, "JOIN #c++", true},
+	{"JOIN ${channel}$", ExpandRegexp, `JOIN #c\+\+$`, true},
+	{"^:${plain}!${any} PRIVMSG", ExpandRegexp, `^:joe!\.\* PRIVMSG`, true},
+	{"^:${plain}!${=any} PRIVMSG", ExpandRegexp, "^:joe!.* PRIVMSG", true},
+	{"no variables", ExpandRegexp, "no variables", true},
+	{"end$", ExpandRegexp, "end$", true},
+	{"${missing} here", ExpandText, " here", false},
+}
+
+func TestExpandVars(t *testing.T) {
+	lookup := func(name string) (string, error) {
+		v, ok := expandVars[name]
+		if !ok {
+			return "", errors.New("unknown variable " + name)
+		}
+		return v, nil
+	}
+	for _, ref := range expandTests {
+		result, err := ExpandVars(ref.Text, ref.Mode, lookup)
+		if result != ref.Result || (err == nil) != ref.OK {
+			t.Errorf("ExpandVars(%q, %d) = %q, %v; want %q, ok=%v",
+				ref.Text, ref.Mode, result, err, ref.Result, ref.OK)
+		}
+	}
+}
+
+var caseTests = []struct {
+	Mapping string
+	Text    string
+	Lower   string
+	Upper   string
+}{
+	{"rfc1459", "Nick[\\]^{|}~", "nick{|}~{|}~", "NICK[\\]^[\\]^"},
+	{"strict-rfc1459", "Nick[\\]^{|}~", "nick{|}^{|}~", "NICK[\\]^[\\]~"},
+	{"ascii", "Nick[\\]^{|}~", "nick[\\]^{|}~", "NICK[\\]^{|}~"},
+	{"unknown", "Nick[\\]^{|}~", "nick{|}~{|}~", "NICK[\\]^[\\]^"},
+}
+
+func TestIrcCase(t *testing.T) {
+	for _, ref := range caseTests {
+		lower := IrcToLower(ref.Text, ref.Mapping)
+		if lower != ref.Lower {
+			t.Errorf("IrcToLower(%q, %q) = %q; want %q",
+				ref.Text, ref.Mapping, lower, ref.Lower)
+		}
+		upper := IrcToUpper(ref.Text, ref.Mapping)
+		if upper != ref.Upper {
+			t.Errorf("IrcToUpper(%q, %q) = %q; want %q",
+				ref.Text, ref.Mapping, upper, ref.Upper)
+		}
+	}
+}
+
+var evalTests = []struct {
+	Expr  string
+	Value int64
+	OK    bool
+}{
+	{"1", 1, true},
+	{" 1 + 2 * 3 ", 7, true},
+	{"(1 + 2) * 3", 9, true},
+	{"10 / 3", 3, true},
+	{"10 % 3", 1, true},
+	{"-4 - -2", -2, true},
+	{"2 * (3 + (4 - 1))", 12, true},
+	{"", 0, false},
+	{"1 +", 0, false},
+	{"(1 + 2", 0, false},
+	{"1 / 0", 0, false},
+	{"3 x", 0, false},
+}
+
+func TestEvalInt(t *testing.T) {
+	for _, ref := range evalTests {
+		value, err := EvalInt(ref.Expr)
+		if (err == nil) != ref.OK || (ref.OK && value != ref.Value) {
+			t.Errorf("EvalInt(%q) = %d, %v; want %d, ok=%v",
+				ref.Expr, value, err, ref.Value, ref.OK)
+		}
+	}
+}
+
+// lookupTests are expanded as seen by the client "alice", with the
+// globals in lookupGlobals.
+var lookupTests = []struct {
+	Text   string
+	Mode   ExpandMode
+	Result string
+	OK     bool
+}{
+	{"${me}", ExpandText, "Al[i]ce", true},
+	{"${greeting}", ExpandText, "hi|there", true},
+	{"${greeting}", ExpandRegexp, `hi\|there`, true},
+	{"${=greeting}", ExpandRegexp, "hi|there", true},
+	{"${away}", ExpandText, "busy", true},
+	{"${alice.away}", ExpandText, "busy", true},
+	{"${bob.away}", ExpandText, "", false},
+	{"${empty:-none}", ExpandText, "none", true},
+	{"${missing:-none}", ExpandText, "none", true},
+	{"${greeting:-none}", ExpandText, "hi|there", true},
+	{"${lower(me)}", ExpandText, "al{i}ce", true},
+	{"${upper(greeting)}", ExpandText, `HI\THERE`, true},
+	{"${upper(missing)}", ExpandText, "", false},
+	{"${counter(a)} ${counter(a)} ${counter(b)}", ExpandText, "1 2 1", true},
+	{"${cap(sasl)} ${cap(away-notify)}", ExpandText, "1 0", true},
+	{"${randnick(0)}", ExpandText, "", false},
+	{"${randnick(x)}", ExpandText, "", false},
+	{"${nosuch(x)}", ExpandText, "", false},
+	{"${missing}", ExpandText, "", false},
+}
+
+var lookupGlobals = map[string]string{
+	"greeting": "hi|there",
+	"empty":    "",
+}
+
+// setTestGlobals replaces the global variables and counters for the
+// duration of a test.
+func setTestGlobals(t *testing.T, vars map[string]string) {
+	oldGlobals, oldCounters := globals, counters
+	globals = make(map[string]string)
+	for name, value := range vars {
+		globals[name] = value
+	}
+	counters = make(map[string]int)
+	t.Cleanup(func() { globals, counters = oldGlobals, oldCounters })
+}
+
+func TestLookupVar(t *testing.T) {
+	client := newTestClient(t, "alice")
+	client.Nickname = "Al[i]ce"
+	client.vars["away"] = "busy"
+	client.caps.enabled = map[string]bool{"sasl": true}
+	for _, ref := range lookupTests {
+		setTestGlobals(t, lookupGlobals)
+		result, err := ExpandVars(ref.Text, ref.Mode, func(name string) (string, error) {
+			return lookupVar(client, name)
+		})
+		if (err == nil) != ref.OK || (ref.OK && result != ref.Result) {
+			t.Errorf("ExpandVars(%q, %d) = %q, %v; want %q, ok=%v",
+				ref.Text, ref.Mode, result, err, ref.Result, ref.OK)
+		}
+	}
+}
+
+func TestLookupGlobal(t *testing.T) {
+	setTestGlobals(t, lookupGlobals)
+	if v, err := expandGlobal("${greeting}", ExpandText); v != "hi|there" || err != nil {
+		t.Errorf("expandGlobal(greeting) = %q, %v", v, err)
+	}
+	if v, err := expandGlobal("${cap(sasl)}", ExpandText); err == nil {
+		t.Errorf("expandGlobal(cap(sasl)) = %q; want error", v)
+	}
+	if v, err := expandGlobal("${me}", ExpandText); err == nil {
+		t.Errorf("expandGlobal(me) = %q; want error", v)
+	}
+}
+
+func TestRandNick(t *testing.T) {
+	for arg, want := range map[string]string{
+		"":   "^[a-zA-Z][a-zA-Z0-9]{8}$",
+		"1":  "^[a-zA-Z]$",
+		"15": "^[a-zA-Z][a-zA-Z0-9]{14}$",
+	} {
+		nick, err := lookupVar(nil, "randnick("+arg+")")
+		if err != nil || !regexp.MustCompile(want).MatchString(nick) {
+			t.Errorf("randnick(%s) = %q, %v; want %s", arg, nick, err, want)
+		}
+	}
+}
+
+var setTests = []struct {
+	Command string
+	Args    []string
+	Name    string
+	Value   string
+	OK      bool
+}{
+	{"SET", []string{"x", "hello"}, "x", "hello", true},
+	{"SET", []string{"x", "${greeting} ${alice.me}"}, "x", "hi|there alice", true},
+	{"SET", []string{"alice.away", "back"}, "alice.away", "back", true},
+	{"SET", []string{"x", "${missing}"}, "x", "", false},
+	{"SET", []string{"x"}, "x", "", false},
+	{"SET", []string{"a:b", "1"}, "a:b", "", false},
+	{"SET", []string{"alice.me", "bob"}, "alice.me", "alice", false},
+	{"SET", []string{"alice.channel", "#c"}, "alice.channel", "", false},
+	{"SET", []string{"bob.away", "back"}, "bob.away", "", false},
+	{"LET", []string{"n", "1 + 2 * 3"}, "n", "7", true},
+	{"LET", []string{"n", "${n} * 2"}, "n", "4", true},
+	{"LET", []string{"alice.n", "${counter(c)} + 1"}, "alice.n", "2", true},
+	{"LET", []string{"n", "${greeting}"}, "n", "2", false},
+	{"LET", []string{"n", "1 / 0"}, "n", "2", false},
+	{"LET", []string{"a(b)", "1"}, "a(b)", "", false},
+}
+
+func TestSetLet(t *testing.T) {
+	client := newTestClient(t, "alice")
+	for _, ref := range setTests {
+		setTestGlobals(t, lookupGlobals)
+		globals["n"] = "2"
+		client.vars = make(map[string]string)
+		before := len(report.Results())
+		if ref.Command == "SET" {
+			doSet(ref.Args)
+		} else {
+			doLet(ref.Args)
+		}
+		if ok := len(report.Results()) == before; ok != ref.OK {
+			t.Errorf("%s %q: ok=%v; want ok=%v", ref.Command, ref.Args, ok, ref.OK)
+		}
+		if v, _ := lookupVar(nil, ref.Name); v != ref.Value {
+			t.Errorf("%s %q: %s = %q; want %q", ref.Command, ref.Args, ref.Name, v, ref.Value)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -27,6 +28,80 @@ type NTuple struct {
 	RemotePort uint16
 }
 
+// TupleOf returns the NTuple for `conn`.
+func TupleOf(conn net.Conn) (res NTuple) {
+	res.LocalAddr, res.LocalPort = SplitAddress(conn.LocalAddr().String())
+	res.RemoteAddr, res.RemotePort = SplitAddress(conn.RemoteAddr().String())
+	return res
+}
+
+// identSlowDelay is how long a SLOW ident reply waits by default.  It is
+// longer than IRC servers wait for ident replies.
+const identSlowDelay = time.Minute
+
+// IdentReply describes how the ident server answers queries about a
+// connection.
+type IdentReply struct {
+	// User is the user ID to reply with.
+	// If it is empty, the client's nickname is used.
+	User string
+
+	// Error is the error to reply with (such as NO-USER), if not empty.
+	Error string
+
+	// Delay is how long to wait before replying.
+	Delay time.Duration
+
+	// Close is true to close the connection without replying.
+	Close bool
+
+	// Malformed is true to send a reply that lacks the user ID field.
+	Malformed bool
+}
+
+// ParseIdentReply parses the username from a CLIENT command.
+// `NO-USER`, `HIDDEN-USER` and `UNKNOWN-ERROR` make the ident server
+// reply with that error, `SLOW[:<duration>]` makes it wait before
+// replying normally, `CLOSE` makes it close the connection without
+// replying, and `MALFORMED` makes it send a malformed reply.
+// Anything else is the user ID for a normal reply.
+func ParseIdentReply(username string) (IdentReply, error) {
+	mode, arg, _ := strings.Cut(username, ":")
+	switch mode {
+	case "NO-USER", "HIDDEN-USER", "UNKNOWN-ERROR":
+		return IdentReply{Error: mode}, nil
+	case "SLOW":
+		reply := IdentReply{Delay: identSlowDelay}
+		if arg != "" {
+			var err error
+			if reply.Delay, err = time.ParseDuration(arg); err != nil {
+				return reply, fmt.Errorf("invalid ident delay %s", arg)
+			}
+		}
+		return reply, nil
+	case "CLOSE":
+		return IdentReply{Close: true}, nil
+	case "MALFORMED":
+		return IdentReply{Malformed: true}, nil
+	}
+	return IdentReply{User: username}, nil
+}
+
+// Format formats the reply to a query for the port pair `ports`.
+// It returns the empty string if the server should close the
+// connection instead.
+func (r IdentReply) Format(ports string) string {
+	switch {
+	case r.Close:
+		return ""
+	case r.Error != "":
+		return fmt.Sprintf("%s : ERROR : %s\r\n", ports, r.Error)
+	case r.Malformed:
+		return fmt.Sprintf("%s : USERID : UNIX\r\n", ports)
+	}
+	return fmt.Sprintf("%s : USERID : UNIX : %s\r\n", ports, r.User)
+}
+
 // Ident implements an RFC 1413 ident server.
 type Ident struct {
 	// Listener is the listener for the server.
@@ -35,10 +110,30 @@ type Ident struct {
 	// Timeout is how long each connection will wait for data.
 	Timeout time.Duration
 
-	// Conns maps NTuple to string responses.
+	// Conns maps a client connection's (local, remote) address tuple,
+	// as an NTuple, to the IdentReply to serve for it.
+	// A client stores its entry before it sends the registration that
+	// makes the server query us.
 	Conns sync.Map
 }
 
+// parsePorts parses an ident query, such as "6193, 23".
+func parsePorts(query string) (local, remote uint16, ok bool) {
+	first, second, found := strings.Cut(query, ",")
+	if !found {
+		return 0, 0, false
+	}
+	localPort, err := strconv.ParseUint(strings.TrimSpace(first), 10, 16)
+	if err != nil || localPort == 0 {
+		return 0, 0, false
+	}
+	remotePort, err := strconv.ParseUint(strings.TrimSpace(second), 10, 16)
+	if err != nil || remotePort == 0 {
+		return 0, 0, false
+	}
+	return uint16(localPort), uint16(remotePort), true
+}
+
 // serveOne performs a single ident lookup.
 func (svc *Ident) serveOne(conn net.Conn) {
 	// The longest normal query will be "12345, 12345\r\n".
@@ -52,27 +147,31 @@ func (svc *Ident) serveOne(conn net.Conn) {
 		return
 	}
 
-	// Construct the lookup key.
-	var tuple NTuple
-	s := strings.TrimRight(string(rbuf[0:n]), "\r\n")
-	count, err := fmt.Sscanf(s, "%d, %d", &tuple.LocalPort, &tuple.RemotePort)
-	if count != 2 || err != nil {
+	// Construct the lookup key.  The query's first port is ours (the
+	// client's), and the second is the querying server's.
+	localPort, remotePort, ok := parsePorts(strings.TrimRight(string(rbuf[:n]), "\r\n"))
+	if !ok {
 		return
 	}
-	tuple.LocalAddr = conn.LocalAddr().String()
-	tuple.RemoteAddr = conn.RemoteAddr().String()
+	tuple := NTuple{LocalPort: localPort, RemotePort: remotePort}
+	tuple.LocalAddr, _ = SplitAddress(conn.LocalAddr().String())
+	tuple.RemoteAddr, _ = SplitAddress(conn.RemoteAddr().String())
 
 	// Construct our response.
-	var resp string
-	if v, ok := svc.Conns.Load(tuple); ok {
-		resp = "ERROR : NO-USER"
-	} else {
-		resp = "GO : " + v.(string)
+	reply := IdentReply{Error: "NO-USER"}
+	if v, found := svc.Conns.Load(tuple); found {
+		reply = v.(IdentReply)
+	}
+	if reply.Delay > 0 {
+		time.Sleep(reply.Delay)
+		conn.SetDeadline(time.Now().Add(svc.Timeout))
 	}
 
 	// Send our response.
-	text := fmt.Sprintf("%s : %s\r\n", s, resp)
-	conn.Write([]byte(text))
+	ports := fmt.Sprintf("%d, %d", tuple.LocalPort, tuple.RemotePort)
+	if text := reply.Format(ports); text != "" {
+		conn.Write([]byte(text))
+	}
 }
 
 // Listen makes the ident server start listening on its server port.
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// memConn is one end of an in-memory connection with TCP addresses.
+type memConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
+
+// memListener is an in-memory net.Listener.
+type memListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	addr  net.Addr
+}
+
+func newMemListener(addr net.Addr) *memListener {
+	return &memListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+		addr:  addr,
+	}
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	close(l.done)
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr { return l.addr }
+
+// Dial connects to the listener from `from`.
+func (l *memListener) Dial(from net.Addr) net.Conn {
+	server, client := net.Pipe()
+	l.conns <- &memConn{Conn: server, local: l.addr, remote: from}
+	return &memConn{Conn: client, local: from, remote: l.addr}
+}
+
+// identAddrs are the ident server's address, as an IRC server sees it,
+// and the IRC server's address.
+var identAddrs = struct{ boss, ircd *net.TCPAddr }{
+	boss: &net.TCPAddr{IP: net.ParseIP("10.11.12.5"), Port: 113},
+	ircd: &net.TCPAddr{IP: net.ParseIP("10.11.12.3"), Port: 40000},
+}
+
+// startIdent starts an ident server on an in-memory listener, with a
+// client (from 10.11.12.5 port 6001 to 10.11.12.3 port 6667) that has
+// the ident reply `reply`.
+func startIdent(t *testing.T, reply IdentReply) (*Ident, *memListener) {
+	listener := newMemListener(identAddrs.boss)
+	svc := &Ident{Listener: listener, Timeout: time.Second}
+	if err := svc.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go svc.Serve()
+	t.Cleanup(func() { svc.Close() })
+
+	svc.Conns.Store(NTuple{
+		LocalAddr:  "10.11.12.5",
+		LocalPort:  6001,
+		RemoteAddr: "10.11.12.3",
+		RemotePort: 6667,
+	}, reply)
+	return svc, listener
+}
+
+// identQuery sends `query` to the ident server, and returns its reply
+// without the line ending, or an error.
+func identQuery(listener *memListener, query string) (string, error) {
+	conn := listener.Dial(identAddrs.ircd)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.WriteString(conn, query); err != nil {
+		return "", err
+	}
+	scanner := bufio.NewScanner(conn)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return scanner.Text(), nil
+}
+
+func TestParseIdentReply(t *testing.T) {
+	cases := []struct {
+		username string
+		want     IdentReply
+	}{
+		{"jdoe", IdentReply{User: "jdoe"}},
+		{"NO-USER", IdentReply{Error: "NO-USER"}},
+		{"HIDDEN-USER", IdentReply{Error: "HIDDEN-USER"}},
+		{"UNKNOWN-ERROR", IdentReply{Error: "UNKNOWN-ERROR"}},
+		{"SLOW", IdentReply{Delay: identSlowDelay}},
+		{"SLOW:5s", IdentReply{Delay: 5 * time.Second}},
+		{"CLOSE", IdentReply{Close: true}},
+		{"MALFORMED", IdentReply{Malformed: true}},
+	}
+	for _, c := range cases {
+		got, err := ParseIdentReply(c.username)
+		if got != c.want || err != nil {
+			t.Errorf("ParseIdentReply(%q) = %+v, %v; want %+v", c.username, got, err, c.want)
+		}
+	}
+	if _, err := ParseIdentReply("SLOW:later"); err == nil {
+		t.Errorf("ParseIdentReply(SLOW:later) succeeded")
+	}
+}
+
+func TestIdentReplies(t *testing.T) {
+	cases := []struct {
+		reply IdentReply
+		want  string
+	}{
+		{IdentReply{User: "jdoe"}, "6001, 6667 : USERID : UNIX : jdoe"},
+		{IdentReply{Error: "HIDDEN-USER"}, "6001, 6667 : ERROR : HIDDEN-USER"},
+		{IdentReply{Error: "UNKNOWN-ERROR"}, "6001, 6667 : ERROR : UNKNOWN-ERROR"},
+		{IdentReply{Malformed: true}, "6001, 6667 : USERID : UNIX"},
+	}
+	for _, c := range cases {
+		_, listener := startIdent(t, c.reply)
+		if got, err := identQuery(listener, "6001 , 6667\r\n"); got != c.want {
+			t.Errorf("reply for %+v = %q, %v; want %q", c.reply, got, err, c.want)
+		}
+	}
+}
+
+func TestIdentUnknown(t *testing.T) {
+	_, listener := startIdent(t, IdentReply{User: "jdoe"})
+
+	// A different port, or a different server, is not the client.
+	want := "6002, 6667 : ERROR : NO-USER"
+	if got, err := identQuery(listener, "6002,6667\r\n"); got != want {
+		t.Errorf("reply = %q, %v; want %q", got, err, want)
+	}
+	want = "6001, 7000 : ERROR : NO-USER"
+	if got, err := identQuery(listener, "6001, 7000\r\n"); got != want {
+		t.Errorf("reply = %q, %v; want %q", got, err, want)
+	}
+
+	// An invalid query gets no reply.
+	if got, err := identQuery(listener, "6001\r\n"); err == nil {
+		t.Errorf("reply to invalid query = %q", got)
+	}
+}
+
+func TestIdentClose(t *testing.T) {
+	_, listener := startIdent(t, IdentReply{Close: true})
+	if got, err := identQuery(listener, "6001, 6667\r\n"); err != io.EOF {
+		t.Errorf("reply = %q, %v; want EOF", got, err)
+	}
+}
+
+func TestIdentSlow(t *testing.T) {
+	_, listener := startIdent(t, IdentReply{User: "jdoe", Delay: 200 * time.Millisecond})
+	start := time.Now()
+	want := "6001, 6667 : USERID : UNIX : jdoe"
+	if got, err := identQuery(listener, "6001, 6667\r\n"); got != want {
+		t.Errorf("reply = %q, %v; want %q", got, err, want)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("slow reply took %v", elapsed)
+	}
+}
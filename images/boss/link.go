@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Link is a server-to-server link that runs through a fault proxy, so
+// that the script can break, delay or stall it.
+type Link struct {
+	// From is the name of the server that connects through the proxy.
+	From string
+
+	// To is the name of the server that the proxy connects to.
+	To string
+}
+
+// links lists the links named by LINK commands.
+var links []Link
+
+// linkHost returns the host name that orchestrate gives to the proxy for
+// the link from `from` to `to`.
+func linkHost(from, to string) string {
+	return "link-" + from + "-" + to
+}
+
+// Proxy returns the host name of the link's fault proxy.
+func (l Link) Proxy() string {
+	return linkHost(l.From, l.To)
+}
+
+// findLinks returns the links between servers `a` and `b` (in either
+// direction), or every link if both are empty.
+func findLinks(a, b string) []Link {
+	a, b = ReplaceSuffix(a), ReplaceSuffix(b)
+	var found []Link
+	for _, l := range links {
+		if (a == "" && b == "") ||
+			(l.From == a && l.To == b) || (l.From == b && l.To == a) {
+			found = append(found, l)
+		}
+	}
+	return found
+}
+
+// doLink handles the LINK command, which names a server link whose
+// proxy orchestrate started.
+// Syntax: `LINK <from> <to>[:<port>]`
+func doLink(args []string) {
+	if len(args) != 2 {
+		report.Errorf(lineno, "COMMAND LINK :expected LINK <from> <to>[:<port>]")
+		return
+	}
+	to, _, _ := strings.Cut(args[1], ":")
+	links = append(links, Link{From: ReplaceSuffix(args[0]), To: ReplaceSuffix(to)})
+}
+
+// linkArgs finds the links named by the first two of `args`, and
+// reports an error if there are none.
+func linkArgs(cmd string, args []string) []Link {
+	if len(args) < 2 {
+		report.Errorf(lineno, "COMMAND %s :expected %s <server> <server>", cmd, cmd)
+		return nil
+	}
+	found := findLinks(args[0], args[1])
+	if len(found) == 0 {
+		report.Errorf(lineno, "COMMAND %s :no LINK between %s and %s",
+			cmd, args[0], args[1])
+	}
+	return found
+}
+
+// linkCommand sends the control command `line` to the proxy for each of
+// `found`, reporting any errors as errors in `cmd`.
+func linkCommand(cmd string, found []Link, line string) {
+	for _, l := range found {
+		if _, err := faultCommand(l.Proxy(), line); err != nil {
+			report.Errorf(lineno, "COMMAND %s :%v", cmd, err)
+		}
+	}
+}
+
+// doSplit handles the SPLIT command.
+// Syntax: `SPLIT <server> <server>`
+func doSplit(args []string) {
+	linkCommand("SPLIT", linkArgs("SPLIT", args), "SPLIT")
+}
+
+// doHeal handles the HEAL command.
+// Syntax: `HEAL [<server> <server>]`
+func doHeal(args []string) {
+	found := links
+	if len(args) > 0 {
+		found = linkArgs("HEAL", args)
+	}
+	linkCommand("HEAL", found, "CLEAR")
+}
+
+// doDelay handles the DELAY command.
+// Syntax: `DELAY <server> <server> <duration>`
+func doDelay(args []string) {
+	if len(args) != 3 {
+		report.Errorf(lineno, "COMMAND DELAY :expected DELAY <server> <server> <duration>")
+		return
+	}
+	delay, err := time.ParseDuration(args[2])
+	if err != nil {
+		report.Errorf(lineno, "COMMAND DELAY :%v", err)
+		return
+	}
+	linkCommand("DELAY", linkArgs("DELAY", args), "latency="+delay.String())
+}
+
+// doDrop handles the DROP command.
+// Syntax: `DROP <server> <server> [on|off]`
+func doDrop(args []string) {
+	drop := true
+	if len(args) == 3 {
+		var err error
+		switch args[2] {
+		case "on":
+		case "off":
+			drop = false
+		default:
+			drop, err = strconv.ParseBool(args[2])
+		}
+		if err != nil {
+			report.Errorf(lineno, "COMMAND DROP :expected on or off, not %s", args[2])
+			return
+		}
+	} else if len(args) != 2 {
+		report.Errorf(lineno, "COMMAND DROP :expected DROP <server> <server> [on|off]")
+		return
+	}
+	linkCommand("DROP", linkArgs("DROP", args), "drop="+strconv.FormatBool(drop))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeFaultProxies answers fault proxies' control commands, recording
+// each as "<proxy>: <command>".
+type fakeFaultProxies struct {
+	mu       sync.Mutex
+	commands []string
+}
+
+// dial works like dialFault, with an in-memory connection.
+func (f *fakeFaultProxies) dial(proxy string) (net.Conn, error) {
+	server, client := net.Pipe()
+	go func() {
+		defer server.Close()
+		line, err := bufio.NewReader(server).ReadString('\n')
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, proxy+": "+strings.TrimRight(line, "\r\n"))
+		f.mu.Unlock()
+		fmt.Fprintf(server, "OK\r\n")
+	}()
+	return client, nil
+}
+
+func TestLinkCommands(t *testing.T) {
+	fake := &fakeFaultProxies{}
+	oldDial, oldLinks := dialFault, links
+	dialFault, links = fake.dial, nil
+	t.Cleanup(func() { dialFault, links = oldDial, oldLinks })
+	nErrors := len(report.Results())
+
+	doLink([]string{"irc-2.example.org", "irc-1.example.org:4401"})
+	doLink([]string{"irc-3.example.org", "irc-1.example.org"})
+	doSplit([]string{"irc-1.example.org", "irc-2.example.org"})
+	doDelay([]string{"irc-3.example.org", "irc-1.example.org", "1.5s"})
+	doDrop([]string{"irc-1.example.org", "irc-3.example.org", "off"})
+	doHeal(nil)
+
+	if n := len(report.Results()); n != nErrors {
+		t.Errorf("link commands reported %d errors", n-nErrors)
+	}
+	link2 := "link-irc-2.example.org-irc-1.example.org: "
+	link3 := "link-irc-3.example.org-irc-1.example.org: "
+	want := []string{
+		link2 + "SPLIT",
+		link3 + "latency=1.5s",
+		link3 + "drop=false",
+		link2 + "CLEAR",
+		link3 + "CLEAR",
+	}
+	if !reflect.DeepEqual(fake.commands, want) {
+		t.Errorf("commands = %q, want %q", fake.commands, want)
+	}
+
+	// A link that was never named is an error.
+	doSplit([]string{"irc-2.example.org", "irc-3.example.org"})
+	if n := len(report.Results()); n != nErrors+1 {
+		t.Errorf("SPLIT of unknown link reported %d errors", n-nErrors)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Message is a parsed IRC message, including any IRCv3 message tags.
+type Message struct {
+	// Tags maps message tag names to their (unescaped) values.
+	// A tag without a value maps to the empty string.
+	Tags map[string]string
+
+	// Source is the message's source (prefix), without the leading ':',
+	// or empty if the message has none.
+	Source string
+
+	// Nick, User and Host are the parts of `Source`, in the form
+	// `<nick>[!<user>][@<host>]`.
+	// A server name is reported as `Nick`.
+	Nick, User, Host string
+
+	// Command is the message's command name or numeric.
+	Command string
+
+	// Params lists the message's parameters, including any trailing
+	// parameter.
+	Params []string
+}
+
+// tagEscapes maps characters that must be escaped in tag values to
+// their escaped forms.
+var tagEscapes = strings.NewReplacer(
+	"\\", "\\\\",
+	";", "\\:",
+	" ", "\\s",
+	"\r", "\\r",
+	"\n", "\\n",
+)
+
+// EscapeTagValue escapes `value` for use as a message tag value.
+func EscapeTagValue(value string) string {
+	return tagEscapes.Replace(value)
+}
+
+// UnescapeTagValue reverses EscapeTagValue().
+// As the IRCv3 specification requires, a backslash before any other
+// character is dropped, as is a backslash at the end of `value`.
+func UnescapeTagValue(value string) string {
+	if !strings.Contains(value, "\\") {
+		return value
+	}
+
+	sb := strings.Builder{}
+	for ii := 0; ii < len(value); ii++ {
+		ch := value[ii]
+		if ch != '\\' {
+			sb.WriteByte(ch)
+			continue
+		}
+		if ii++; ii == len(value) {
+			break
+		}
+		switch ch = value[ii]; ch {
+		case ':':
+			sb.WriteByte(';')
+		case 's':
+			sb.WriteByte(' ')
+		case 'r':
+			sb.WriteByte('\r')
+		case 'n':
+			sb.WriteByte('\n')
+		default:
+			sb.WriteByte(ch)
+		}
+	}
+	return sb.String()
+}
+
+// SplitSource splits a message source of the form
+// `<nick>[!<user>][@<host>]` into its parts.
+func SplitSource(source string) (nick, user, host string) {
+	nick, host, _ = strings.Cut(source, "@")
+	nick, user, _ = strings.Cut(nick, "!")
+	return nick, user, host
+}
+
+// isCommand returns true if `s` is a valid command name or numeric.
+func isCommand(s string) bool {
+	for ii := 0; ii < len(s); ii++ {
+		ch := s[ii]
+		if !(('0' <= ch && ch <= '9') || ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z')) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// cutWord splits `line` at the first space, and trims leading spaces
+// from the rest.
+func cutWord(line string) (word, rest string) {
+	word, rest, _ = strings.Cut(line, " ")
+	return word, strings.TrimLeft(rest, " ")
+}
+
+// ParseMessage parses an IRC message from `line`.
+// Leading spaces and trailing CR and LF characters are ignored, but
+// NUL, CR and LF are not allowed elsewhere.
+func ParseMessage(line string) (*Message, error) {
+	msg := &Message{}
+	line = IrcTrim(line)
+	if strings.ContainsAny(line, "\x00\r\n") {
+		return nil, errors.New("invalid character in message")
+	}
+
+	// Are there message tags?
+	if line != "" && line[0] == '@' {
+		var tags string
+		tags, line = cutWord(line[1:])
+		for _, tag := range strings.Split(tags, ";") {
+			key, value, _ := strings.Cut(tag, "=")
+			if key == "" {
+				continue
+			}
+			if msg.Tags == nil {
+				msg.Tags = make(map[string]string)
+			}
+			msg.Tags[key] = UnescapeTagValue(value)
+		}
+	}
+
+	// Is there a source?
+	if line != "" && line[0] == ':' {
+		msg.Source, line = cutWord(line[1:])
+		if msg.Source == "" {
+			return nil, errors.New("empty message source")
+		}
+		msg.Nick, msg.User, msg.Host = SplitSource(msg.Source)
+	}
+
+	// Get the command.
+	msg.Command, line = cutWord(line)
+	if msg.Command == "" {
+		return nil, errors.New("missing command")
+	}
+	if !isCommand(msg.Command) {
+		return nil, errors.New("invalid command " + msg.Command)
+	}
+
+	// Get the parameters.
+	for line != "" {
+		if line[0] == ':' {
+			msg.Params = append(msg.Params, line[1:])
+			break
+		}
+		var param string
+		param, line = cutWord(line)
+		msg.Params = append(msg.Params, param)
+	}
+
+	return msg, nil
+}
+
+// Param returns the `n`th parameter of the message, or the empty string
+// if there are not that many parameters.
+func (msg *Message) Param(n int) string {
+	if n < 0 || n >= len(msg.Params) {
+		return ""
+	}
+	return msg.Params[n]
+}
+
+// String formats the message as an IRC line, without a trailing CRLF.
+// Tags are written in sorted order, so the result is deterministic.
+func (msg *Message) String() string {
+	sb := strings.Builder{}
+
+	// Write the tags.
+	if len(msg.Tags) > 0 {
+		keys := make([]string, 0, len(msg.Tags))
+		for key := range msg.Tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		sb.WriteByte('@')
+		for ii, key := range keys {
+			if ii > 0 {
+				sb.WriteByte(';')
+			}
+			sb.WriteString(key)
+			if value := msg.Tags[key]; value != "" {
+				sb.WriteByte('=')
+				sb.WriteString(EscapeTagValue(value))
+			}
+		}
+		sb.WriteByte(' ')
+	}
+
+	// Write the source and command.
+	if msg.Source != "" {
+		sb.WriteByte(':')
+		sb.WriteString(msg.Source)
+		sb.WriteByte(' ')
+	}
+	sb.WriteString(msg.Command)
+
+	// Write the parameters.
+	for ii, param := range msg.Params {
+		sb.WriteByte(' ')
+		if ii == len(msg.Params)-1 &&
+			(param == "" || param[0] == ':' || strings.IndexByte(param, ' ') >= 0) {
+			sb.WriteByte(':')
+		}
+		sb.WriteString(param)
+	}
+
+	return sb.String()
+}
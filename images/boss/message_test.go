@@ -0,0 +1,152 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		line string
+		want Message
+	}{
+		{"PING :irc.example.org\r\n", Message{
+			Command: "PING",
+			Params:  []string{"irc.example.org"},
+		}},
+		{":nick!user@host PRIVMSG #chan :hello  world", Message{
+			Source:  "nick!user@host",
+			Nick:    "nick",
+			User:    "user",
+			Host:    "host",
+			Command: "PRIVMSG",
+			Params:  []string{"#chan", "hello  world"},
+		}},
+		{"@time=2024-01-01T00:00:00Z;+draft/x=a\\sb\\:c\\\\d;flag :irc.example.org 001 me :Welcome", Message{
+			Tags: map[string]string{
+				"time":     "2024-01-01T00:00:00Z",
+				"+draft/x": "a b;c\\d",
+				"flag":     "",
+			},
+			Source:  "irc.example.org",
+			Nick:    "irc.example.org",
+			Command: "001",
+			Params:  []string{"me", "Welcome"},
+		}},
+		{"@a=b  :n@h   MODE  #c +o   n ", Message{
+			Tags:    map[string]string{"a": "b"},
+			Source:  "n@h",
+			Nick:    "n",
+			Host:    "h",
+			Command: "MODE",
+			Params:  []string{"#c", "+o", "n"},
+		}},
+		{":Joe SCHMOE :world\r\n", Message{
+			Source:  "Joe",
+			Nick:    "Joe",
+			Command: "SCHMOE",
+			Params:  []string{"world"},
+		}},
+		{"HELLO :world\r\n", Message{
+			Command: "HELLO",
+			Params:  []string{"world"},
+		}},
+		{"CAP * LS :", Message{
+			Command: "CAP",
+			Params:  []string{"*", "LS", ""},
+		}},
+	}
+	for _, tc := range tests {
+		msg, err := ParseMessage(tc.line)
+		if err != nil {
+			t.Errorf("ParseMessage(%q) failed: %v", tc.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(*msg, tc.want) {
+			t.Errorf("ParseMessage(%q) = %+v; want %+v", tc.line, *msg, tc.want)
+		}
+	}
+}
+
+func TestParseMessageErrors(t *testing.T) {
+	for _, line := range []string{"", "\r\n", "@a=b", ":source", ": PING", "@a :src", "PRIV:MSG x"} {
+		if msg, err := ParseMessage(line); err == nil {
+			t.Errorf("ParseMessage(%q) = %+v; want error", line, *msg)
+		}
+	}
+}
+
+func TestUnescapeTagValue(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"plain", "plain"},
+		{"\\s\\:\\\\\\r\\n", " ;\\\r\n"},
+		{"a\\b", "ab"},
+		{"trailing\\", "trailing"},
+	}
+	for _, tc := range tests {
+		if got := UnescapeTagValue(tc.in); got != tc.out {
+			t.Errorf("UnescapeTagValue(%q) = %q; want %q", tc.in, got, tc.out)
+		}
+	}
+	if got := EscapeTagValue(" ;\\\r\n"); got != "\\s\\:\\\\\\r\\n" {
+		t.Errorf("EscapeTagValue() = %q", got)
+	}
+}
+
+func TestMessageString(t *testing.T) {
+	msg := Message{
+		Tags:    map[string]string{"b": "x y", "a": ""},
+		Source:  "srv",
+		Command: "NOTICE",
+		Params:  []string{"*", ":-)"},
+	}
+	want := "@a;b=x\\sy :srv NOTICE * ::-)"
+	if got := msg.String(); got != want {
+		t.Errorf("String() = %q; want %q", got, want)
+	}
+}
+
+// sameMessage compares messages, treating nil and empty tags or
+// parameters as equal.
+func sameMessage(a, b *Message) bool {
+	if len(a.Tags) != len(b.Tags) || len(a.Params) != len(b.Params) {
+		return false
+	}
+	if len(a.Tags) > 0 && !reflect.DeepEqual(a.Tags, b.Tags) {
+		return false
+	}
+	if len(a.Params) > 0 && !reflect.DeepEqual(a.Params, b.Params) {
+		return false
+	}
+	return a.Source == b.Source && a.Nick == b.Nick && a.User == b.User &&
+		a.Host == b.Host && a.Command == b.Command
+}
+
+func FuzzParseMessage(f *testing.F) {
+	f.Add("PING :irc.example.org")
+	f.Add(":nick!user@host PRIVMSG #chan :hello world")
+	f.Add("@time=2024-01-01T00:00:00Z;msgid=a\\sb :srv 005 me CASEMAPPING=ascii :are supported")
+	f.Add("@a;b= :x CAP * LS :")
+	f.Fuzz(func(t *testing.T, line string) {
+		msg, err := ParseMessage(line)
+		if err != nil {
+			return
+		}
+
+		// Formatting and re-parsing must give the same message, and
+		// the formatted text must be stable.
+		text := msg.String()
+		again, err := ParseMessage(text)
+		if err != nil {
+			t.Fatalf("ParseMessage(%q) failed after ParseMessage(%q): %v", text, line, err)
+		}
+		if !sameMessage(msg, again) {
+			t.Fatalf("ParseMessage(%q) = %+v; want %+v", text, *again, *msg)
+		}
+		if text2 := again.String(); text2 != text {
+			t.Fatalf("String() = %q; want %q", text2, text)
+		}
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var configDir = flag.String("configs", "/etc/boss/configs",
+	"Directory with servers' config files that have variants")
+
+// switchVariant replaces each of `server`'s config files under `dir`
+// that has a variant named `variant` with that variant.
+// It returns the number of files that it replaced.
+//
+// The server sees each file through a bind mount of the same host file
+// that orchestrate mounts here (see finishVariants there), so the file
+// is rewritten in place; replacing it (such as by renaming a new file
+// over it) would leave the server with the old file.
+func switchVariant(dir, server, variant string) (int, error) {
+	noVariant := errors.New("no config variant " + variant + " for " + server)
+	serverDir := filepath.Join(dir, server)
+	if _, err := os.Stat(serverDir); errors.Is(err, fs.ErrNotExist) {
+		return 0, noVariant
+	}
+
+	suffix := "@" + variant
+	count := 0
+	err := filepath.WalkDir(serverDir,
+		func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !strings.HasSuffix(path, suffix) {
+				return err
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			target := strings.TrimSuffix(path, suffix)
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_TRUNC, 0)
+			if err != nil {
+				return err
+			}
+			_, err = f.Write(data)
+			if err2 := f.Close(); err == nil {
+				err = err2
+			}
+			count++
+			return err
+		})
+	if err == nil && count == 0 {
+		err = noVariant
+	}
+	return count, err
+}
+
+// doReconfig handles the RECONFIG command, which switches a server's
+// config files to a variant and then rehashes the server.
+// Syntax: `RECONFIG <server> <variant>`
+// Returns true if the command should be retried later.
+func doReconfig(args []string) bool {
+	if pendingContainerOp != nil {
+		return checkContainerOp("RECONFIG")
+	}
+	if len(args) != 2 {
+		report.Errorf(lineno, "COMMAND RECONFIG :expected RECONFIG <server> <variant>")
+		return false
+	}
+	server := ReplaceSuffix(args[0])
+	if _, err := switchVariant(*configDir, server, args[1]); err != nil {
+		report.Errorf(lineno, "COMMAND RECONFIG :%v", err)
+		return false
+	}
+	startContainerOp(func(e *Engine) error {
+		return e.Lifecycle("REHASH", server, "")
+	})
+	return true
+}
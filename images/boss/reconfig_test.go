@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSwitchVariant(t *testing.T) {
+	dir := t.TempDir()
+	confDir := filepath.Join(dir, "irc-1.example.org", "usr", "lib")
+	if err := os.MkdirAll(confDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"ircd.conf":         "original conf",
+		"ircd.conf@default": "original conf",
+		"ircd.conf@v2":      "v2 conf",
+		"ircd.motd":         "original motd",
+	}
+	for name, text := range files {
+		if err := os.WriteFile(filepath.Join(confDir, name), []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The file is rewritten in place, not replaced.
+	live := filepath.Join(confDir, "ircd.conf")
+	before, err := os.Stat(live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(want string) {
+		t.Helper()
+		data, err := os.ReadFile(live)
+		if err != nil || string(data) != want {
+			t.Errorf("ircd.conf = %q, %v; want %q", data, err, want)
+		}
+		if after, err := os.Stat(live); err != nil || !os.SameFile(before, after) {
+			t.Errorf("ircd.conf was replaced")
+		}
+	}
+
+	if n, err := switchVariant(dir, "irc-1.example.org", "v2"); n != 1 || err != nil {
+		t.Errorf("switchVariant(v2) = %d, %v", n, err)
+	}
+	check("v2 conf")
+	if n, err := switchVariant(dir, "irc-1.example.org", "default"); n != 1 || err != nil {
+		t.Errorf("switchVariant(default) = %d, %v", n, err)
+	}
+	check("original conf")
+	if _, err := switchVariant(dir, "irc-1.example.org", "v3"); err == nil {
+		t.Errorf("switchVariant(v3) succeeded")
+	}
+	want := "no config variant v2 for irc-2.example.org"
+	if _, err := switchVariant(dir, "irc-2.example.org", "v2"); err == nil || err.Error() != want {
+		t.Errorf("switchVariant for unknown server = %v, want %q", err, want)
+	}
+}
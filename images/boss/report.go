@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Outcome describes how a scripted check was resolved.
+type Outcome int
+
+const (
+	// Matched means the check was satisfied.
+	Matched Outcome = iota
+
+	// TimedOut means a non-fatal check was not satisfied in time.
+	TimedOut
+
+	// Fatal means a fatal check failed, which stops the script.
+	Fatal
+
+	// Errored means the script itself had a problem, such as a bad
+	// command or an unknown client name.
+	Errored
+
+	// Absent means no line matched a negative check during its window.
+	Absent
+
+	// Unexpected means a line matched a non-fatal negative check.
+	Unexpected
+)
+
+// outcomeNames gives the external (report) names for each Outcome.
+var outcomeNames = [...]string{
+	Matched:    "matched",
+	TimedOut:   "timeout",
+	Fatal:      "fatal",
+	Errored:    "error",
+	Absent:     "absent",
+	Unexpected: "unexpected",
+}
+
+// String returns the report name for `o`.
+func (o Outcome) String() string {
+	if o < 0 || int(o) >= len(outcomeNames) {
+		return fmt.Sprintf("Outcome(%d)", int(o))
+	}
+	return outcomeNames[o]
+}
+
+// MarshalText encodes `o` using its report name.
+func (o Outcome) MarshalText() ([]byte, error) {
+	return []byte(o.String()), nil
+}
+
+// Failed returns true if `o` should make the script fail.
+func (o Outcome) Failed() bool {
+	return o != Matched && o != Absent
+}
+
+// Result records the outcome of one scripted check.
+type Result struct {
+	// File names the included file that created the check, or is empty
+	// for the main script.
+	File string `json:"file,omitempty"`
+
+	// Line is the script line number that created the check.
+	Line int `json:"line"`
+
+	// Command is the script command, such as "EXPECT" or "WAIT".
+	Command string `json:"command"`
+
+	// Client names the client the check applies to, if any.
+	Client string `json:"client,omitempty"`
+
+	// Text is the pattern or other argument of the command.
+	Text string `json:"text,omitempty"`
+
+	// Outcome is how the check was resolved.
+	Outcome Outcome `json:"outcome"`
+
+	// Duration is how long the check took to resolve.
+	Duration time.Duration `json:"duration_ns"`
+
+	// Message gives details about a failure.
+	Message string `json:"message,omitempty"`
+}
+
+// Report collects the results of running a script.
+// It is safe for concurrent use.
+type Report struct {
+	// Script is the name of the script being run.
+	Script string
+
+	// Start is when the script started running.
+	Start time.Time
+
+	// mu serializes access to `results`.
+	mu sync.Mutex
+
+	// results lists the check results in the order they resolved.
+	results []Result
+}
+
+// report is the report for the current script.
+var report = Report{Start: time.Now()}
+
+// Add records a result.
+func (r *Report) Add(res Result) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.results = append(r.results, res)
+}
+
+// Errorf prints an error message from the script and records it as an
+// Errored result for script line `line` of the current file.
+// The message is printed as "ERROR <text>".
+func (r *Report) Errorf(line int, format string, args ...any) {
+	r.ErrorAt(linefile, line, format, args...)
+}
+
+// ErrorAt works like Errorf(), but for a line of the included file
+// `file` (or the main script, if `file` is empty).
+// The message is printed as "ERROR <file>:<line>: <text>" for a line of
+// an included file.
+func (r *Report) ErrorAt(file string, line int, format string, args ...any) {
+	text := fmt.Sprintf(format, args...)
+	if file != "" {
+		fmt.Printf("ERROR %s:%d: %s\n", file, line, text)
+	} else {
+		fmt.Printf("ERROR %s\n", text)
+	}
+	r.Add(Result{
+		File:    file,
+		Line:    line,
+		Command: "ERROR",
+		Outcome: Errored,
+		Message: text,
+	})
+}
+
+// Failed returns true if any recorded result is a failure.
+func (r *Report) Failed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, res := range r.results {
+		if res.Outcome.Failed() {
+			return true
+		}
+	}
+	return false
+}
+
+// Results returns a copy of the results recorded so far.
+func (r *Report) Results() []Result {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Result(nil), r.results...)
+}
+
+// Summary is the JSON representation of a Report.
+type Summary struct {
+	// Script is the name of the script that was run.
+	Script string `json:"script"`
+
+	// Start is when the script started running.
+	Start time.Time `json:"start"`
+
+	// Duration is how long the script ran.
+	Duration time.Duration `json:"duration_ns"`
+
+	// Passed is true if no result failed.
+	Passed bool `json:"passed"`
+
+	// Counts maps outcome names to the number of results with them.
+	Counts map[string]int `json:"counts"`
+
+	// Results lists the individual results.
+	Results []Result `json:"results"`
+}
+
+// Summarize converts `r` to a Summary as of `now`.
+func (r *Report) Summarize(now time.Time) *Summary {
+	s := &Summary{
+		Script:   r.Script,
+		Start:    r.Start,
+		Duration: now.Sub(r.Start),
+		Passed:   true,
+		Counts:   make(map[string]int),
+		Results:  r.Results(),
+	}
+	for _, res := range s.Results {
+		s.Counts[res.Outcome.String()]++
+		if res.Outcome.Failed() {
+			s.Passed = false
+		}
+	}
+	return s
+}
+
+// WriteJSON writes the JSON summary of `r` to `w`.
+func (r *Report) WriteJSON(w io.Writer, now time.Time) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r.Summarize(now))
+}
+
+// junitSuites is the root element of a JUnit XML report.
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Name     string       `xml:"name,attr"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Errors   int          `xml:"errors,attr"`
+	Time     string       `xml:"time,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+// junitSuite is one test suite in a JUnit XML report.
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Errors    int         `xml:"errors,attr"`
+	Time      string      `xml:"time,attr"`
+	Timestamp string      `xml:"timestamp,attr"`
+	Cases     []junitCase `xml:"testcase"`
+}
+
+// junitCase is one test case in a JUnit XML report.
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Error     *junitFailure `xml:"error,omitempty"`
+}
+
+// junitFailure describes why a JUnit test case failed.
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junitTime formats `d` as JUnit expects: decimal seconds.
+func junitTime(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// WriteJUnit writes `r` as JUnit XML to `w`.
+func (r *Report) WriteJUnit(w io.Writer, now time.Time) error {
+	s := r.Summarize(now)
+	suite := junitSuite{
+		Name:      s.Script,
+		Tests:     len(s.Results),
+		Time:      junitTime(s.Duration),
+		Timestamp: s.Start.UTC().Format(time.RFC3339),
+		Cases:     make([]junitCase, 0, len(s.Results)),
+	}
+	for _, res := range s.Results {
+		tc := junitCase{
+			Name:      fmt.Sprintf("line %d: %s", res.Line, res.Command),
+			ClassName: s.Script,
+			Time:      junitTime(res.Duration),
+		}
+		if res.File != "" {
+			tc.Name = fmt.Sprintf("%s:%d: %s", res.File, res.Line, res.Command)
+		}
+		if res.Client != "" {
+			tc.Name += " " + res.Client
+		}
+		if res.Outcome.Failed() {
+			f := &junitFailure{
+				Message: res.Message,
+				Type:    res.Outcome.String(),
+				Text:    res.Text,
+			}
+			if res.Outcome == Errored {
+				tc.Error = f
+				suite.Errors++
+			} else {
+				tc.Failure = f
+				suite.Failures++
+			}
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(&junitSuites{
+		Name:     "boss",
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Errors:   suite.Errors,
+		Time:     suite.Time,
+		Suites:   []junitSuite{suite},
+	}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// writeFile creates `name` and calls `fn` to fill it.
+func writeFile(name string, fn func(io.Writer) error) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err = fn(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// WriteFiles writes "junit.xml" and "summary.json" reports into `dir`.
+func (r *Report) WriteFiles(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	err := writeFile(filepath.Join(dir, "junit.xml"), func(w io.Writer) error {
+		return r.WriteJUnit(w, now)
+	})
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(dir, "summary.json"), func(w io.Writer) error {
+		return r.WriteJSON(w, now)
+	})
+}
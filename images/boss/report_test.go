@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// reportStart is the start time of the test reports.
+var reportStart = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func TestOutcomeFailed(t *testing.T) {
+	cases := []struct {
+		outcome Outcome
+		name    string
+		failed  bool
+	}{
+		{Matched, "matched", false},
+		{TimedOut, "timeout", true},
+		{Fatal, "fatal", true},
+		{Errored, "error", true},
+		{Absent, "absent", false},
+		{Unexpected, "unexpected", true},
+		{Outcome(99), "Outcome(99)", true},
+	}
+	for _, c := range cases {
+		if c.outcome.String() != c.name || c.outcome.Failed() != c.failed {
+			t.Errorf("Outcome %d: name %q, failed %v; want %q, %v", int(c.outcome),
+				c.outcome.String(), c.outcome.Failed(), c.name, c.failed)
+		}
+	}
+}
+
+func TestReportWriters(t *testing.T) {
+	matched := Result{Line: 3, Command: "EXPECT", Client: "user1", Text: "001",
+		Outcome: Matched, Duration: 250 * time.Millisecond}
+	absent := Result{Line: 4, Command: "EXPECT-NOT", Client: "user1", Text: "KILL",
+		Outcome: Absent, Duration: time.Second}
+	timedOut := Result{File: "lib.script", Line: 7, Command: "EXPECT", Client: "user2",
+		Text: "JOIN", Outcome: TimedOut, Duration: 10 * time.Second,
+		Message: "timed out"}
+	errored := Result{Line: 9, Command: "ERROR", Outcome: Errored,
+		Message: "COMMAND FOO :unknown command"}
+
+	cases := []struct {
+		name     string
+		results  []Result
+		passed   bool
+		counts   map[string]int
+		failures int
+		errors   int
+		cases    []string
+	}{
+		{"empty", nil, true, map[string]int{}, 0, 0, nil},
+		{"pass", []Result{matched, absent}, true,
+			map[string]int{"matched": 1, "absent": 1}, 0, 0,
+			[]string{"line 3: EXPECT user1", "line 4: EXPECT-NOT user1"}},
+		{"fail", []Result{matched, timedOut}, false,
+			map[string]int{"matched": 1, "timeout": 1}, 1, 0,
+			[]string{"line 3: EXPECT user1", "lib.script:7: EXPECT user2"}},
+		{"error", []Result{errored, matched}, false,
+			map[string]int{"error": 1, "matched": 1}, 0, 1,
+			[]string{"line 9: ERROR", "line 3: EXPECT user1"}},
+	}
+	for _, c := range cases {
+		r := &Report{Script: "irc.script", Start: reportStart}
+		for _, res := range c.results {
+			r.Add(res)
+		}
+		now := reportStart.Add(90 * time.Second)
+		if r.Failed() == c.passed {
+			t.Errorf("%s: Failed() = %v", c.name, r.Failed())
+		}
+
+		// Check the JSON summary.
+		sb := &strings.Builder{}
+		if err := r.WriteJSON(sb, now); err != nil {
+			t.Fatalf("%s: WriteJSON: %v", c.name, err)
+		}
+		var s struct {
+			Script   string         `json:"script"`
+			Start    time.Time      `json:"start"`
+			Duration int64          `json:"duration_ns"`
+			Passed   bool           `json:"passed"`
+			Counts   map[string]int `json:"counts"`
+			Results  []struct {
+				Outcome string `json:"outcome"`
+				Line    int    `json:"line"`
+			} `json:"results"`
+		}
+		if err := json.Unmarshal([]byte(sb.String()), &s); err != nil {
+			t.Fatalf("%s: JSON summary: %v\n%s", c.name, err, sb)
+		}
+		if s.Script != "irc.script" || !s.Start.Equal(reportStart) ||
+			s.Duration != int64(90*time.Second) || s.Passed != c.passed ||
+			!reflect.DeepEqual(s.Counts, c.counts) || len(s.Results) != len(c.results) {
+			t.Errorf("%s: JSON summary = %s", c.name, sb)
+		}
+		for ii, res := range s.Results {
+			if res.Outcome != c.results[ii].Outcome.String() || res.Line != c.results[ii].Line {
+				t.Errorf("%s: JSON result %d = %+v", c.name, ii, res)
+			}
+		}
+
+		// Check the JUnit report.
+		sb.Reset()
+		if err := r.WriteJUnit(sb, now); err != nil {
+			t.Fatalf("%s: WriteJUnit: %v", c.name, err)
+		}
+		if !strings.HasPrefix(sb.String(), xml.Header) {
+			t.Errorf("%s: JUnit report has no XML header", c.name)
+		}
+		var suites junitSuites
+		if err := xml.Unmarshal([]byte(sb.String()), &suites); err != nil {
+			t.Fatalf("%s: JUnit report: %v\n%s", c.name, err, sb)
+		}
+		if len(suites.Suites) != 1 || suites.Tests != len(c.results) ||
+			suites.Failures != c.failures || suites.Errors != c.errors ||
+			suites.Time != "90.000" {
+			t.Errorf("%s: JUnit report = %s", c.name, sb)
+			continue
+		}
+		suite := suites.Suites[0]
+		if suite.Name != "irc.script" || suite.Timestamp != "2026-01-02T03:04:05Z" ||
+			suite.Failures != c.failures || suite.Errors != c.errors {
+			t.Errorf("%s: JUnit suite = %+v", c.name, suite)
+		}
+		var names []string
+		for ii, tc := range suite.Cases {
+			names = append(names, tc.Name)
+			res := c.results[ii]
+			switch {
+			case res.Outcome == Errored:
+				if tc.Error == nil || tc.Failure != nil || tc.Error.Message != res.Message {
+					t.Errorf("%s: case %q error = %+v", c.name, tc.Name, tc.Error)
+				}
+			case res.Outcome.Failed():
+				if tc.Failure == nil || tc.Error != nil || tc.Failure.Type != res.Outcome.String() ||
+					tc.Failure.Text != res.Text {
+					t.Errorf("%s: case %q failure = %+v", c.name, tc.Name, tc.Failure)
+				}
+			default:
+				if tc.Failure != nil || tc.Error != nil {
+					t.Errorf("%s: passing case %q has a failure", c.name, tc.Name)
+				}
+			}
+		}
+		if !reflect.DeepEqual(names, c.cases) {
+			t.Errorf("%s: JUnit cases = %q, want %q", c.name, names, c.cases)
+		}
+	}
+}
+
+func TestReportWriteFiles(t *testing.T) {
+	r := &Report{Script: "irc.script", Start: reportStart}
+	r.Add(Result{Line: 1, Command: "WAIT", Outcome: Matched})
+	dir := filepath.Join(t.TempDir(), "reports")
+	if err := r.WriteFiles(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"junit.xml", "summary.json"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// saslChunk is the longest AUTHENTICATE payload in one message.
+const saslChunk = 400
+
+// SASLMech is a client's side of a SASL mechanism.
+type SASLMech interface {
+	// Name returns the mechanism's name, such as "PLAIN".
+	Name() string
+
+	// Step returns the client's response to the server's challenge.
+	// The first call has an empty challenge.
+	Step(challenge []byte) ([]byte, error)
+}
+
+// NewSASLMech creates the SASL mechanism named `name`, authenticating
+// as `account` with `password`.
+func NewSASLMech(name, account, password string) (SASLMech, error) {
+	switch strings.ToUpper(name) {
+	case "EXTERNAL":
+		return &saslExternal{}, nil
+	case "PLAIN":
+		return &saslPlain{account: account, password: password}, nil
+	case "SCRAM-SHA-256":
+		nonce := make([]byte, 18)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		return &saslScram{
+			hash:     sha256.New,
+			name:     "SCRAM-SHA-256",
+			account:  account,
+			password: password,
+			nonce:    base64.RawStdEncoding.EncodeToString(nonce),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported SASL mechanism %s", name)
+}
+
+// saslExternal implements the EXTERNAL mechanism, which relies on the
+// client's TLS certificate.
+type saslExternal struct{}
+
+// Name implements SASLMech.
+func (*saslExternal) Name() string {
+	return "EXTERNAL"
+}
+
+// Step implements SASLMech.
+func (*saslExternal) Step([]byte) ([]byte, error) {
+	return nil, nil
+}
+
+// saslPlain implements the PLAIN mechanism (RFC 4616).
+type saslPlain struct {
+	account, password string
+}
+
+// Name implements SASLMech.
+func (*saslPlain) Name() string {
+	return "PLAIN"
+}
+
+// Step implements SASLMech.
+func (m *saslPlain) Step([]byte) ([]byte, error) {
+	return []byte("\x00" + m.account + "\x00" + m.password), nil
+}
+
+// saslScram implements the SCRAM mechanisms (RFC 5802), without
+// channel binding.
+type saslScram struct {
+	hash     func() hash.Hash
+	name     string
+	account  string
+	password string
+
+	// nonce is the client's nonce.
+	nonce string
+
+	// step counts the calls to Step().
+	step int
+
+	// clientFirstBare is the client's first message, without the GS2
+	// header.
+	clientFirstBare string
+
+	// serverSignature is the signature we expect from the server.
+	serverSignature []byte
+}
+
+// Name implements SASLMech.
+func (m *saslScram) Name() string {
+	return m.name
+}
+
+// scramEscape escapes a SCRAM user name.
+var scramEscape = strings.NewReplacer("=", "=3D", ",", "=2C")
+
+// scramAttrs parses a SCRAM message into its attributes.
+func scramAttrs(msg string) map[byte]string {
+	attrs := make(map[byte]string)
+	for _, field := range strings.Split(msg, ",") {
+		if len(field) >= 2 && field[1] == '=' {
+			attrs[field[0]] = field[2:]
+		}
+	}
+	return attrs
+}
+
+// hmacSum returns the HMAC of `data` using `key`.
+func (m *saslScram) hmacSum(key []byte, data string) []byte {
+	mac := hmac.New(m.hash, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// pbkdf2 derives a key from `password` and `salt` as PBKDF2 (RFC 8018)
+// does, with an output as long as the hash.
+func (m *saslScram) pbkdf2(password string, salt []byte, iter int) []byte {
+	mac := hmac.New(m.hash, []byte(password))
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := append([]byte(nil), u...)
+	for ii := 1; ii < iter; ii++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for jj := range result {
+			result[jj] ^= u[jj]
+		}
+	}
+	return result
+}
+
+// Step implements SASLMech.
+func (m *saslScram) Step(challenge []byte) ([]byte, error) {
+	m.step++
+	switch m.step {
+	case 1:
+		m.clientFirstBare = "n=" + scramEscape.Replace(m.account) + ",r=" + m.nonce
+		return []byte("n,," + m.clientFirstBare), nil
+
+	case 2:
+		serverFirst := string(challenge)
+		attrs := scramAttrs(serverFirst)
+		nonce, salt64, iterText := attrs['r'], attrs['s'], attrs['i']
+		if !strings.HasPrefix(nonce, m.nonce) || len(nonce) == len(m.nonce) {
+			return nil, errors.New("SCRAM server nonce does not extend ours")
+		}
+		salt, err := base64.StdEncoding.DecodeString(salt64)
+		if err != nil {
+			return nil, fmt.Errorf("SCRAM salt: %v", err)
+		}
+		iter, err := strconv.Atoi(iterText)
+		if err != nil || iter < 1 {
+			return nil, fmt.Errorf("SCRAM iteration count %q", iterText)
+		}
+
+		// Calculate the proof and the server's signature.
+		salted := m.pbkdf2(m.password, salt, iter)
+		clientKey := m.hmacSum(salted, "Client Key")
+		h := m.hash()
+		h.Write(clientKey)
+		storedKey := h.Sum(nil)
+		clientFinalBare := "c=biws,r=" + nonce
+		authMessage := m.clientFirstBare + "," + serverFirst + "," + clientFinalBare
+		proof := m.hmacSum(storedKey, authMessage)
+		for ii := range proof {
+			proof[ii] ^= clientKey[ii]
+		}
+		serverKey := m.hmacSum(salted, "Server Key")
+		m.serverSignature = m.hmacSum(serverKey, authMessage)
+
+		return []byte(clientFinalBare + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+
+	case 3:
+		attrs := scramAttrs(string(challenge))
+		if e, ok := attrs['e']; ok {
+			return nil, fmt.Errorf("SCRAM server error: %s", e)
+		}
+		sig, err := base64.StdEncoding.DecodeString(attrs['v'])
+		if err != nil || subtle.ConstantTimeCompare(sig, m.serverSignature) != 1 {
+			return nil, errors.New("SCRAM server signature does not match")
+		}
+		return nil, nil
+	}
+
+	return nil, errors.New("unexpected SCRAM challenge")
+}
+
+// saslState tracks a client's SASL exchange during registration.
+// It is protected by the client's `registeredCond.L`.
+type saslState struct {
+	// mech is the mechanism in use, or nil.
+	mech SASLMech
+
+	// challenge accumulates a challenge that spans several
+	// AUTHENTICATE messages.
+	challenge strings.Builder
+}
+
+// Account returns the services account the client is logged in to, or
+// the empty string.
+func (c *ClientConn) Account() string {
+	c.registeredCond.L.Lock()
+	defer c.registeredCond.L.Unlock()
+	return c.account
+}
+
+// saslLines encodes a SASL response as AUTHENTICATE messages.
+func saslLines(response []byte) []string {
+	text := base64.StdEncoding.EncodeToString(response)
+	var lines []string
+	for len(text) >= saslChunk {
+		lines = append(lines, "AUTHENTICATE "+text[:saslChunk])
+		text = text[saslChunk:]
+	}
+	if text == "" {
+		text = "+"
+	}
+	return append(lines, "AUTHENTICATE "+text)
+}
+
+// startSASL begins SASL authentication, once the server has acknowledged
+// the "sasl" capability.
+func (c *ClientConn) startSASL() []string {
+	account := c.Options.Account
+	if account == "" {
+		account = c.Nickname
+	}
+	mech, err := NewSASLMech(c.Options.SASL, account, c.Options.Password)
+	if err != nil {
+		fmt.Printf("ERROR SASL %s :%v\n", c.Name, err)
+		return c.endCapNegotiation()
+	}
+	c.sasl.mech = mech
+	return []string{"AUTHENTICATE " + mech.Name()}
+}
+
+// handleAuthenticate processes an AUTHENTICATE message from the server
+// and returns the lines to send in reply.
+func (c *ClientConn) handleAuthenticate(msg *Message) []string {
+	c.registeredCond.L.Lock()
+	defer c.registeredCond.L.Unlock()
+	if c.sasl.mech == nil || len(msg.Params) < 1 {
+		return nil
+	}
+
+	// Is the challenge complete?
+	chunk := msg.Params[0]
+	if chunk != "+" {
+		c.sasl.challenge.WriteString(chunk)
+	}
+	if len(chunk) == saslChunk {
+		return nil
+	}
+	text := c.sasl.challenge.String()
+	c.sasl.challenge.Reset()
+
+	// Calculate the response.
+	challenge, err := base64.StdEncoding.DecodeString(text)
+	var response []byte
+	if err == nil {
+		response, err = c.sasl.mech.Step(challenge)
+	}
+	if err != nil {
+		fmt.Printf("ERROR SASL %s :%v\n", c.Name, err)
+		return []string{"AUTHENTICATE *"}
+	}
+	return saslLines(response)
+}
+
+// handleSASLNumeric processes a numeric reply about SASL or the
+// client's account, and returns the lines to send in reply.
+func (c *ClientConn) handleSASLNumeric(msg *Message) []string {
+	c.registeredCond.L.Lock()
+	defer c.registeredCond.L.Unlock()
+
+	switch msg.Command {
+	case "900": // RPL_LOGGEDIN
+		c.account = msg.Param(2)
+		return nil
+	case "901": // RPL_LOGGEDOUT
+		c.account = ""
+		return nil
+	case "902", "903", "904", "905", "906", "907":
+		// ERR_NICKLOCKED, RPL_SASLSUCCESS, ERR_SASLFAIL,
+		// ERR_SASLTOOLONG, ERR_SASLABORTED, ERR_SASLALREADY
+		if c.sasl.mech == nil {
+			return nil
+		}
+		c.sasl.mech = nil
+		if !c.caps.negotiating {
+			return nil
+		}
+		return c.endCapNegotiation()
+	}
+	return nil
+}
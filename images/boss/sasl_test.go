@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestSASLPlain(t *testing.T) {
+	mech, err := NewSASLMech("plain", "acct", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := mech.Step(nil)
+	if err != nil || string(resp) != "\x00acct\x00secret" {
+		t.Errorf("Step() = %q, %v", resp, err)
+	}
+}
+
+func TestSASLScram(t *testing.T) {
+	// This is the example exchange from RFC 7677.
+	mech := &saslScram{
+		hash:     sha256.New,
+		name:     "SCRAM-SHA-256",
+		account:  "user",
+		password: "pencil",
+		nonce:    "rOprNGfwEbeRWgbNEkqO",
+	}
+	steps := []struct {
+		challenge, response string
+	}{
+		{"", "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"},
+		{"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="},
+		{"v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=", ""},
+	}
+	for _, step := range steps {
+		resp, err := mech.Step([]byte(step.challenge))
+		if err != nil {
+			t.Fatalf("Step(%q) failed: %v", step.challenge, err)
+		}
+		if string(resp) != step.response {
+			t.Fatalf("Step(%q) = %q; want %q", step.challenge, resp, step.response)
+		}
+	}
+}
+
+func TestSASLScramBadSignature(t *testing.T) {
+	mech := &saslScram{
+		hash:     sha256.New,
+		name:     "SCRAM-SHA-256",
+		account:  "us=er,",
+		password: "pencil",
+		nonce:    "abc",
+	}
+	if resp, _ := mech.Step(nil); string(resp) != "n,,n=us=3Der=2C,r=abc" {
+		t.Errorf("Step() = %q", resp)
+	}
+	if _, err := mech.Step([]byte("r=abc,s=QSXCR+Q6sek8bf92,i=4096")); err == nil {
+		t.Errorf("Step() accepted a nonce without a server part")
+	}
+	if _, err := mech.Step([]byte("r=abcdef,s=QSXCR+Q6sek8bf92,i=4096")); err != nil {
+		t.Fatalf("Step() failed: %v", err)
+	}
+	if _, err := mech.Step([]byte("v=AAAA")); err == nil {
+		t.Errorf("Step() accepted a bad server signature")
+	}
+}
+
+func TestSASLLines(t *testing.T) {
+	if lines := saslLines(nil); len(lines) != 1 || lines[0] != "AUTHENTICATE +" {
+		t.Errorf("saslLines(nil) = %q", lines)
+	}
+
+	// A payload of exactly 400 bytes must be followed by "+".
+	lines := saslLines(make([]byte, 300))
+	if len(lines) != 2 || len(lines[0]) != len("AUTHENTICATE ")+saslChunk ||
+		lines[1] != "AUTHENTICATE +" {
+		t.Errorf("saslLines(300 bytes) = %q", lines)
+	}
+
+	payload := strings.Repeat("x", 700)
+	var text string
+	for _, line := range saslLines([]byte(payload)) {
+		text += strings.TrimPrefix(line, "AUTHENTICATE ")
+	}
+	if decoded, _ := base64.StdEncoding.DecodeString(text); string(decoded) != payload {
+		t.Errorf("saslLines() did not round-trip")
+	}
+}
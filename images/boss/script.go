@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ScriptLine is one non-blank, non-comment line of a script.
+type ScriptLine struct {
+	// File names the included file that holds the line, or is empty for
+	// the main script.
+	File string
+
+	// Lineno is the line's number within its file.
+	Lineno int
+
+	// Text is the text of the line.
+	Text string
+
+	// Parts is the line split by ScriptSplitLine().
+	Parts []string
+
+	// Open is the index of the line that opens the block this line
+	// closes, for END and ELSE lines.
+	Open int
+
+	// Else is the index of the ELSE line for an IF, or -1.
+	Else int
+
+	// End is the index of the END line for a line that opens a block.
+	End int
+}
+
+// Script is a parsed script, with its block structure resolved.
+type Script struct {
+	// Name is the file name of the script.
+	Name string
+
+	// Lines lists the script's lines.
+	Lines []ScriptLine
+
+	// Procs maps procedure names to the index of their PROC line.
+	Procs map[string]int
+
+	// lib holds the files that INCLUDE can read.
+	lib fs.FS
+}
+
+// Where returns the file name and line number of `line`, for messages.
+func (script *Script) Where(line *ScriptLine) string {
+	if line.File == "" {
+		return fmt.Sprintf("%s:%d", script.Name, line.Lineno)
+	}
+	return fmt.Sprintf("%s:%d", line.File, line.Lineno)
+}
+
+// opensBlock returns true if `parts` starts a block that ends with END.
+func opensBlock(parts []string) bool {
+	switch parts[0] {
+	case "IF", "PROC", "REPEAT":
+		return true
+	case "EXPECT":
+		return len(parts) == 3 && (parts[1] == "ALL" || parts[1] == "ANY")
+	}
+	return false
+}
+
+// splitScriptLine calls ScriptSplitLine(), converting a panic into an
+// error.
+func splitScriptLine(text string) (parts []string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return ScriptSplitLine(text), nil
+}
+
+// LoadScript reads a script from `r`, which is named `name` in errors.
+// `INCLUDE <file>` lines are replaced by the lines of `<file>` from
+// `lib`.
+// It matches each block-opening line with its ELSE and END lines;
+// blocks cannot span files.
+func LoadScript(r io.Reader, name string, lib fs.FS) (*Script, error) {
+	script := &Script{Name: name, Procs: make(map[string]int), lib: lib}
+	if err := script.load(r, "", nil); err != nil {
+		return nil, err
+	}
+	return script, nil
+}
+
+// load appends the lines from `r` to `script`.
+// `file` is the name of an included file, or empty for the main script.
+// `stack` lists the files that are being included, to detect cycles.
+func (script *Script) load(r io.Reader, file string, stack []string) error {
+	var open []int
+	where := func(lineno int) string {
+		return script.Where(&ScriptLine{File: file, Lineno: lineno})
+	}
+
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 4096), 32768)
+	for lineno := 1; s.Scan(); lineno++ {
+		parts, err := splitScriptLine(s.Text())
+		if err != nil {
+			return fmt.Errorf("%s: %v", where(lineno), err)
+		}
+		if parts == nil {
+			continue
+		}
+
+		// Is it an INCLUDE?
+		if parts[0] == "INCLUDE" {
+			if err := script.include(parts, stack); err != nil {
+				return fmt.Errorf("%s: %v", where(lineno), err)
+			}
+			continue
+		}
+
+		idx := len(script.Lines)
+		script.Lines = append(script.Lines, ScriptLine{
+			File:   file,
+			Lineno: lineno,
+			Text:   s.Text(),
+			Parts:  parts,
+			Else:   -1,
+		})
+		line := &script.Lines[idx]
+
+		switch {
+		case opensBlock(parts):
+			open = append(open, idx)
+		case parts[0] == "ELSE":
+			if len(open) == 0 || script.Lines[open[len(open)-1]].Parts[0] != "IF" {
+				return fmt.Errorf("%s: ELSE without IF", where(lineno))
+			}
+			ifLine := &script.Lines[open[len(open)-1]]
+			if ifLine.Else >= 0 {
+				return fmt.Errorf("%s: second ELSE for IF", where(lineno))
+			}
+			ifLine.Else = idx
+			line.Open = open[len(open)-1]
+		case parts[0] == "END":
+			if len(open) == 0 {
+				return fmt.Errorf("%s: END without a block", where(lineno))
+			}
+			line.Open = open[len(open)-1]
+			script.Lines[line.Open].End = idx
+			open = open[:len(open)-1]
+		}
+
+		if parts[0] == "PROC" {
+			if len(parts) != 2 {
+				return fmt.Errorf("%s: expected PROC <name>", where(lineno))
+			}
+			if prev, ok := script.Procs[parts[1]]; ok {
+				return fmt.Errorf("%s: PROC %s already defined at %s",
+					where(lineno), parts[1], script.Where(&script.Lines[prev]))
+			}
+			script.Procs[parts[1]] = idx
+		}
+	}
+	if err := s.Err(); err != nil {
+		if file == "" {
+			file = script.Name
+		}
+		return fmt.Errorf("%s: %v", file, err)
+	}
+
+	if len(open) > 0 {
+		line := &script.Lines[open[len(open)-1]]
+		return fmt.Errorf("%s: %s without END", script.Where(line), line.Parts[0])
+	}
+
+	return nil
+}
+
+// include loads the file named by an INCLUDE line.
+// Syntax: `INCLUDE <file>`
+func (script *Script) include(parts []string, stack []string) error {
+	if len(parts) != 2 {
+		return fmt.Errorf("expected INCLUDE <file>")
+	}
+	file := parts[1]
+	if !fs.ValidPath(file) {
+		return fmt.Errorf("invalid INCLUDE file name %s", file)
+	}
+	for _, other := range stack {
+		if other == file {
+			return fmt.Errorf("INCLUDE cycle: %s -> %s",
+				strings.Join(stack, " -> "), file)
+		}
+	}
+	if script.lib == nil {
+		return fmt.Errorf("no INCLUDE directory")
+	}
+
+	f, err := script.lib.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return script.load(f, file, append(stack, file))
+}
+
+// frame is an entry in the script's control stack.
+type frame struct {
+	// open is the index of the REPEAT or PROC line for this frame.
+	open int
+
+	// remaining counts the iterations left, for a REPEAT.
+	remaining int64
+
+	// count is the total number of iterations, for a REPEAT.
+	count int64
+
+	// counter names the variable that holds the iteration number, if
+	// any, for a REPEAT.
+	counter string
+
+	// ret is the index of the line to return to, for a CALL.
+	ret int
+}
+
+// maxFrames limits how deeply REPEAT and CALL can nest.
+const maxFrames = 256
+
+// script is the script being executed.
+var script *Script
+
+// pc is the index of the script line being executed.
+var pc int
+
+// frames is the control stack for REPEAT and CALL.
+var frames []frame
+
+// retrying is true if the current script line is being retried.
+var retrying bool
+
+// runScript executes the current script line, or retries it.
+// Returns false if the script has ended.
+func runScript(textChan chan TextLine) bool {
+	if pc >= len(script.Lines) {
+		log.Printf("end of script")
+		return false
+	}
+
+	line := &script.Lines[pc]
+	linefile, lineno = line.File, line.Lineno
+	if !retrying {
+		if line.File != "" {
+			log.Printf("%s: %s\n", script.Where(line), line.Text)
+		} else {
+			log.Printf("%s\n", line.Text)
+		}
+	}
+
+	// Is it a control-flow line?
+	if next, ok := executeControl(line); ok {
+		pc, retrying = next, false
+		return true
+	}
+
+	// Execute it.
+	if retrying = executeLine(line.Parts, line.Text, textChan); retrying {
+		blocked = true
+	} else {
+		pc++
+	}
+
+	return true
+}
+
+// executeControl executes `line` if it is a control-flow command.
+// Returns the index of the next line to execute, and true if `line` was
+// a control-flow command.
+func executeControl(line *ScriptLine) (int, bool) {
+	switch line.Parts[0] {
+	case "CALL":
+		return doCall(line), true
+	case "ELSE":
+		// We only get here at the end of the IF's "true" branch.
+		return script.Lines[line.Open].End, true
+	case "END":
+		return doEndBlock(line)
+	case "IF":
+		return doIf(line), true
+	case "PROC":
+		// Skip the body; it only runs for CALL.
+		return line.End + 1, true
+	case "REPEAT":
+		return doRepeat(line), true
+	}
+	return 0, false
+}
+
+// doCall runs a procedure.
+// Syntax: `CALL <name>`
+func doCall(line *ScriptLine) int {
+	next := pc + 1
+	if len(line.Parts) != 2 {
+		report.Errorf(lineno, "COMMAND CALL :expected CALL <name>")
+		return next
+	}
+	proc, ok := script.Procs[line.Parts[1]]
+	if !ok {
+		report.Errorf(lineno, "COMMAND CALL :unknown PROC %s", line.Parts[1])
+		return next
+	}
+	if len(frames) >= maxFrames {
+		report.Errorf(lineno, "COMMAND CALL :too deeply nested")
+		return next
+	}
+
+	frames = append(frames, frame{open: proc, ret: next})
+	return proc + 1
+}
+
+// doEndBlock closes a REPEAT, IF or PROC block.
+// Returns false for the END of an `EXPECT ALL` or `EXPECT ANY`, which
+// executeLine() handles.
+func doEndBlock(line *ScriptLine) (int, bool) {
+	open := &script.Lines[line.Open]
+	switch open.Parts[0] {
+	case "IF":
+		return pc + 1, true
+
+	case "PROC":
+		// Return to the caller.
+		top := frames[len(frames)-1]
+		frames = frames[:len(frames)-1]
+		return top.ret, true
+
+	case "REPEAT":
+		// Is there another iteration?
+		top := &frames[len(frames)-1]
+		if top.remaining--; top.remaining <= 0 {
+			frames = frames[:len(frames)-1]
+			return pc + 1, true
+		}
+		if top.counter != "" {
+			globals[top.counter] = strconv.FormatInt(top.count-top.remaining+1, 10)
+		}
+		return line.Open + 1, true
+	}
+
+	return 0, false
+}
+
+// doIf conditionally runs a block.
+// Syntax: `IF <value> =~|!~ :<regexp>` or `IF <value> ==|!= :<value>`
+// followed by lines to run if the condition is true, then optionally
+// `ELSE` and lines to run if it is false, and then `END`.
+// Variables are expanded in both operands; values expanded into the
+// regexp are quoted unless written as `${=name}`.
+func doIf(line *ScriptLine) int {
+	skip := line.End
+	if line.Else >= 0 {
+		skip = line.Else + 1
+	}
+
+	cond, err := evalCondition(line.Parts[1:])
+	if err != nil {
+		report.Errorf(lineno, "COMMAND IF :%v", err)
+		return skip
+	}
+	if !cond {
+		return skip
+	}
+	return pc + 1
+}
+
+// evalCondition evaluates the condition of an IF command.
+func evalCondition(args []string) (bool, error) {
+	if len(args) != 3 {
+		return false, fmt.Errorf("expected IF <value> <op> :<value>")
+	}
+	lhs, err := expandGlobal(args[0], ExpandText)
+	if err != nil {
+		return false, err
+	}
+
+	switch args[1] {
+	case "==", "!=":
+		rhs, err := expandGlobal(args[2], ExpandText)
+		return (lhs == rhs) == (args[1] == "=="), err
+
+	case "=~", "!~":
+		pattern, err := expandGlobal(args[2], ExpandRegexp)
+		if err != nil {
+			return false, err
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return false, err
+		}
+		return re.MatchString(lhs) == (args[1] == "=~"), nil
+	}
+
+	return false, fmt.Errorf("unknown operator %s", args[1])
+}
+
+// doRepeat runs a block several times.
+// Syntax: `REPEAT <count> [<name>]` followed by lines to repeat and then
+// `END`.
+// `<count>` is expanded and evaluated like LET's expression.
+// If `<name>` is given, the global variable with that name holds the
+// iteration number, starting from 1.
+func doRepeat(line *ScriptLine) int {
+	args := line.Parts[1:]
+	if len(args) < 1 || len(args) > 2 {
+		report.Errorf(lineno, "COMMAND REPEAT :expected REPEAT <count> [<name>]")
+		return line.End + 1
+	}
+	expr, err := expandGlobal(args[0], ExpandText)
+	if err != nil {
+		report.Errorf(lineno, "COMMAND REPEAT :%v", err)
+		return line.End + 1
+	}
+	count, err := EvalInt(expr)
+	if err != nil {
+		report.Errorf(lineno, "COMMAND REPEAT :%v", err)
+		return line.End + 1
+	}
+	if count <= 0 {
+		return line.End + 1
+	}
+	if len(frames) >= maxFrames {
+		report.Errorf(lineno, "COMMAND REPEAT :too deeply nested")
+		return line.End + 1
+	}
+
+	f := frame{open: pc, remaining: count, count: count}
+	if len(args) > 1 {
+		f.counter = args[1]
+		globals[f.counter] = "1"
+	}
+	frames = append(frames, f)
+	return pc + 1
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadScriptBlocks(t *testing.T) {
+	text := `PROC greet
+  :a PRIVMSG #x :hi
+END
+
+REPEAT 2 i
+  IF ${i} =~ :1
+    CALL greet
+  ELSE
+    EXPECT ALL a
+    MATCH :hi
+    END
+  END
+END
+`
+	script, err := LoadScript(strings.NewReader(text), "test", nil)
+	if err != nil {
+		t.Fatalf("LoadScript() failed: %v", err)
+	}
+	if len(script.Lines) != 12 {
+		t.Fatalf("LoadScript() gave %d lines; want 12", len(script.Lines))
+	}
+	if proc, ok := script.Procs["greet"]; !ok || proc != 0 {
+		t.Errorf("Procs[greet] = %v, %v; want 0, true", proc, ok)
+	}
+
+	// Check each opener's END (and ELSE) by script line number.
+	ends := []struct {
+		open, end, els int
+	}{
+		{1, 3, -1},
+		{5, 13, -1},
+		{6, 12, 8},
+		{9, 11, -1},
+	}
+	byLineno := make(map[int]int)
+	for idx, line := range script.Lines {
+		byLineno[line.Lineno] = idx
+	}
+	for _, tc := range ends {
+		line := script.Lines[byLineno[tc.open]]
+		if end := script.Lines[line.End].Lineno; end != tc.end {
+			t.Errorf("line %d ends at line %d; want %d", tc.open, end, tc.end)
+		}
+		if tc.els >= 0 && (line.Else < 0 || script.Lines[line.Else].Lineno != tc.els) {
+			t.Errorf("line %d has ELSE at index %d; want line %d", tc.open, line.Else, tc.els)
+		}
+	}
+}
+
+func TestLoadScriptErrors(t *testing.T) {
+	tests := []struct {
+		text, err string
+	}{
+		{"END\n", "test:1: END without a block"},
+		{"WAIT\nELSE\n", "test:2: ELSE without IF"},
+		{"REPEAT 2\nELSE\nEND\n", "test:2: ELSE without IF"},
+		{"IF a == :a\nELSE\nELSE\nEND\n", "test:3: second ELSE for IF"},
+		{"WAIT\nREPEAT 2\n", "test:2: REPEAT without END"},
+		{"PROC a\nEND\nPROC a\nEND\n", "test:3: PROC a already defined at test:1"},
+		{"PROC\nEND\n", "test:1: expected PROC <name>"},
+	}
+	for _, tc := range tests {
+		_, err := LoadScript(strings.NewReader(tc.text), "test", nil)
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("LoadScript(%q) = %v; want %q", tc.text, err, tc.err)
+		}
+	}
+}
+
+func TestLoadScriptInclude(t *testing.T) {
+	lib := fstest.MapFS{
+		"register.script":    {Data: []byte("PROC register\n  :a NICK a\nEND\nINCLUDE common/join.script\n")},
+		"common/join.script": {Data: []byte("\n:a JOIN #x\n")},
+	}
+	text := "CLIENT a irc-1...\nINCLUDE register.script\nCALL register\n"
+	script, err := LoadScript(strings.NewReader(text), "test", lib)
+	if err != nil {
+		t.Fatalf("LoadScript() failed: %v", err)
+	}
+
+	want := []string{
+		"test:1", "register.script:1", "register.script:2",
+		"register.script:3", "common/join.script:2", "test:3",
+	}
+	if len(script.Lines) != len(want) {
+		t.Fatalf("LoadScript() gave %d lines; want %d", len(script.Lines), len(want))
+	}
+	for idx := range script.Lines {
+		if where := script.Where(&script.Lines[idx]); where != want[idx] {
+			t.Errorf("line %d is at %s; want %s", idx, where, want[idx])
+		}
+	}
+}
+
+func TestLoadScriptIncludeErrors(t *testing.T) {
+	lib := fstest.MapFS{
+		"a.script":    {Data: []byte("WAIT\nINCLUDE b.script\n")},
+		"b.script":    {Data: []byte("INCLUDE a.script\n")},
+		"open.script": {Data: []byte("REPEAT 2\n")},
+		"end.script":  {Data: []byte("END\n")},
+	}
+	tests := []struct {
+		text, err string
+	}{
+		{"INCLUDE a.script\n", "test:1: a.script:2: b.script:1: INCLUDE cycle: a.script -> b.script -> a.script"},
+		{"WAIT\nINCLUDE missing.script\n", "test:2: open missing.script: file does not exist"},
+		{"INCLUDE ../x.script\n", "test:1: invalid INCLUDE file name ../x.script"},
+		{"INCLUDE open.script\nEND\n", "test:1: open.script:1: REPEAT without END"},
+		{"REPEAT 2\nINCLUDE end.script\n", "test:2: end.script:1: END without a block"},
+	}
+	for _, tc := range tests {
+		_, err := LoadScript(strings.NewReader(tc.text), "test", lib)
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("LoadScript(%q) = %v; want %q", tc.text, err, tc.err)
+		}
+	}
+}
+
+// runControl runs the script `text`, carrying out its control-flow lines
+// and recording the other lines, with their variables expanded, instead
+// of executing them.
+func runControl(t *testing.T, text string) []string {
+	t.Helper()
+	s, err := LoadScript(strings.NewReader(text), "test", nil)
+	if err != nil {
+		t.Fatalf("LoadScript() failed: %v", err)
+	}
+	setTestGlobals(t, nil)
+	oldScript, oldPC, oldFrames := script, pc, frames
+	t.Cleanup(func() { script, pc, frames = oldScript, oldPC, oldFrames })
+	script, pc, frames = s, 0, nil
+
+	var ran []string
+	for steps := 0; pc < len(script.Lines); steps++ {
+		if steps > 1000 {
+			t.Fatalf("script did not end; ran %q", ran)
+		}
+		line := &script.Lines[pc]
+		linefile, lineno = line.File, line.Lineno
+		if next, ok := executeControl(line); ok {
+			pc = next
+			continue
+		}
+		expanded, err := expandGlobal(strings.TrimSpace(line.Text), ExpandText)
+		if err != nil {
+			t.Errorf("line %d: %v", line.Lineno, err)
+		}
+		ran = append(ran, expanded)
+		pc++
+	}
+	if len(frames) != 0 {
+		t.Errorf("%d frames left at the end of the script", len(frames))
+	}
+	return ran
+}
+
+func TestRunControl(t *testing.T) {
+	tests := []struct {
+		name, text string
+		ran        []string
+		errors     int
+	}{
+		{"repeat", "REPEAT 3 i\n  RUN ${i}\nEND\nRUN done\n",
+			[]string{"RUN 1", "RUN 2", "RUN 3", "RUN done"}, 0},
+		{"repeat without counter", "REPEAT 1+1\n  RUN a\nEND\n",
+			[]string{"RUN a", "RUN a"}, 0},
+		{"repeat zero", "REPEAT 0\n  RUN a\nEND\nRUN b\n",
+			[]string{"RUN b"}, 0},
+		{"nested repeat", "REPEAT 2 i\n  REPEAT 2 j\n    RUN ${i}.${j}\n  END\nEND\n",
+			[]string{"RUN 1.1", "RUN 1.2", "RUN 2.1", "RUN 2.2"}, 0},
+		{"repeat error", "REPEAT x\n  RUN a\nEND\nRUN b\n",
+			[]string{"RUN b"}, 1},
+		{"if true", "IF a == :a\n  RUN yes\nELSE\n  RUN no\nEND\nRUN after\n",
+			[]string{"RUN yes", "RUN after"}, 0},
+		{"if false", "IF a != :a\n  RUN yes\nELSE\n  RUN no\nEND\nRUN after\n",
+			[]string{"RUN no", "RUN after"}, 0},
+		{"if without else", "IF abc !~ :^b\n  RUN yes\nEND\nIF abc =~ :^b\n  RUN no\nEND\n",
+			[]string{"RUN yes"}, 0},
+		{"if in repeat", "REPEAT 3 i\n  IF ${i} == :2\n    RUN two\n  ELSE\n    RUN ${i}\n  END\nEND\n",
+			[]string{"RUN 1", "RUN two", "RUN 3"}, 0},
+		{"if error", "IF a <> :a\n  RUN yes\nELSE\n  RUN no\nEND\n",
+			[]string{"RUN no"}, 1},
+		{"call", "PROC p\n  RUN in p\nEND\nRUN start\nCALL p\nCALL p\nRUN end\n",
+			[]string{"RUN start", "RUN in p", "RUN in p", "RUN end"}, 0},
+		{"nested call", "PROC a\n  RUN a\n  CALL b\nEND\nPROC b\n  RUN b\nEND\nCALL a\nRUN end\n",
+			[]string{"RUN a", "RUN b", "RUN end"}, 0},
+		{"call in repeat", "PROC p\n  RUN p${i}\nEND\nREPEAT 2 i\n  CALL p\nEND\n",
+			[]string{"RUN p1", "RUN p2"}, 0},
+		{"unknown proc", "CALL nope\nRUN after\n",
+			[]string{"RUN after"}, 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			before := len(report.Results())
+			ran := runControl(t, tc.text)
+			if strings.Join(ran, "\n") != strings.Join(tc.ran, "\n") {
+				t.Errorf("ran %q; want %q", ran, tc.ran)
+			}
+			if errors := len(report.Results()) - before; errors != tc.errors {
+				t.Errorf("reported %d errors; want %d", errors, tc.errors)
+			}
+		})
+	}
+}
+
+func TestRunControlRecursion(t *testing.T) {
+	before := len(report.Results())
+	oldScript, oldPC, oldFrames := script, pc, frames
+	t.Cleanup(func() { script, pc, frames = oldScript, oldPC, oldFrames })
+
+	s, err := LoadScript(strings.NewReader("PROC p\n  CALL p\nEND\nCALL p\n"), "test", nil)
+	if err != nil {
+		t.Fatalf("LoadScript() failed: %v", err)
+	}
+	script, pc, frames = s, 3, nil
+	for steps := 0; pc < len(script.Lines) && steps < 10*maxFrames; steps++ {
+		pc, _ = executeControl(&script.Lines[pc])
+	}
+	if pc != len(script.Lines) || len(frames) != 0 {
+		t.Errorf("recursive CALL stopped at line %d with %d frames", pc, len(frames))
+	}
+	if errors := len(report.Results()) - before; errors != 1 {
+		t.Errorf("recursive CALL reported %d errors; want 1", errors)
+	}
+}
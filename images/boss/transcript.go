@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var replayMode = flag.Bool("replay", false,
+	"Write an irc.script skeleton for the transcript files named by the arguments, then exit")
+
+// Transcript directions.  A transcript starts with a connect entry, and
+// ends with a close entry if the connection failed or was closed.
+const (
+	// DirConnect records the server the client connects to.
+	DirConnect = "connect"
+
+	// DirSend records a line that the client sent.
+	DirSend = "send"
+
+	// DirRecv records a line that the client received.
+	DirRecv = "recv"
+
+	// DirClose records why the client's connection ended.
+	DirClose = "close"
+)
+
+// TranscriptEntry is one line of a client's transcript.
+type TranscriptEntry struct {
+	// Client names the client.
+	Client string `json:"client"`
+
+	// Time is the wall-clock time of the entry.
+	Time time.Time `json:"time"`
+
+	// Elapsed is the (monotonic) time since boss started.
+	Elapsed time.Duration `json:"elapsed_ns"`
+
+	// Dir is DirConnect, DirSend, DirRecv or DirClose.
+	Dir string `json:"dir"`
+
+	// Text is the server for DirConnect, the line for DirSend and
+	// DirRecv, or the error for DirClose.
+	Text string `json:"text"`
+}
+
+// Transcript writes a client's session as JSON lines, one
+// TranscriptEntry per line.
+type Transcript struct {
+	// Client names the client.
+	Client string
+
+	// mu serializes writes, which come from the script and the
+	// client's reader.
+	mu sync.Mutex
+
+	// f is the transcript file.
+	f *os.File
+}
+
+// transcriptsOpened holds the names of clients whose transcripts were
+// opened by this run, so a reused name appends to its transcript.
+var transcriptsOpened = map[string]bool{}
+
+// OpenTranscript opens the transcript for `client` under `dir`.
+func OpenTranscript(dir, client string) (*Transcript, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if !transcriptsOpened[client] {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(filepath.Join(dir, client+".jsonl"), flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	transcriptsOpened[client] = true
+	return &Transcript{Client: client, f: f}, nil
+}
+
+// Record adds an entry to the transcript.  `t` may be nil, in which
+// case nothing is recorded.
+func (t *Transcript) Record(dir, text string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	line, err := json.Marshal(TranscriptEntry{
+		Client:  t.Client,
+		Time:    now,
+		Elapsed: now.Sub(report.Start),
+		Dir:     dir,
+		Text:    text,
+	})
+	if err != nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, _ = t.f.Write(append(line, '\n'))
+}
+
+// Close closes the transcript file.
+func (t *Transcript) Close() error {
+	if t == nil {
+		return nil
+	}
+	return t.f.Close()
+}
+
+// ReadTranscript reads the entries from a transcript.
+func ReadTranscript(r io.Reader) ([]TranscriptEntry, error) {
+	var entries []TranscriptEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), 1<<20)
+	for scanner.Scan() {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var entry TranscriptEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// replayPattern returns a regexp, for EXPECT, that matches the received
+// line `text` without its tags and source, which can differ between
+// runs.  It escapes `$`, so the pattern does not expand variables.
+func replayPattern(text string) string {
+	if strings.HasPrefix(text, "@") {
+		_, text, _ = strings.Cut(text, " ")
+		text = strings.TrimLeft(text, " ")
+	}
+	if strings.HasPrefix(text, ":") {
+		_, text, _ = strings.Cut(text, " ")
+		text = strings.TrimLeft(text, " ")
+	}
+	return strings.ReplaceAll(regexp.QuoteMeta(text), `\$`, `\x24`)
+}
+
+// WriteSkeleton writes an irc.script skeleton that replays `entries`,
+// in order of their elapsed times: a CLIENT line for each connection,
+// SEND for each line a client sent after registering, and EXPECT for
+// each line it received.  Lines that boss sends or handles itself, such
+// as registration and PONG, are left out.
+func WriteSkeleton(w io.Writer, entries []TranscriptEntry) error {
+	entries = append([]TranscriptEntry(nil), entries...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Elapsed < entries[j].Elapsed
+	})
+
+	bw := bufio.NewWriter(w)
+	registered := make(map[string]bool)
+	for _, e := range entries {
+		switch e.Dir {
+		case DirConnect:
+			registered[e.Client] = false
+			fmt.Fprintf(bw, "CLIENT %s %s\n", e.Client, e.Text)
+		case DirSend:
+			if !registered[e.Client] || strings.HasPrefix(e.Text, "PONG ") {
+				continue
+			}
+			// SEND would expand `$` as a variable reference.
+			if strings.ContainsRune(e.Text, '$') {
+				bw.WriteString("# ")
+			}
+			fmt.Fprintf(bw, "SEND %s :%s\n", e.Client, e.Text)
+		case DirRecv:
+			if msg, err := ParseMessage(e.Text); err == nil {
+				if msg.Command == "PING" {
+					continue
+				} else if msg.Command == "001" {
+					registered[e.Client] = true
+				}
+			}
+			fmt.Fprintf(bw, "EXPECT %s :%s\n", e.Client, replayPattern(e.Text))
+		case DirClose:
+			fmt.Fprintf(bw, "# %s closed: %s\n", e.Client, e.Text)
+		}
+	}
+	return bw.Flush()
+}
+
+// replay writes an irc.script skeleton, to stdout, for the transcript
+// files in `names`.
+func replay(names []string) error {
+	var entries []TranscriptEntry
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		more, err := ReadTranscript(f)
+		_ = f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		entries = append(entries, more...)
+	}
+	return WriteSkeleton(os.Stdout, entries)
+}
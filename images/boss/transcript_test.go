@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTranscript(t *testing.T) {
+	dir := t.TempDir()
+	tr, err := OpenTranscript(dir, "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Record(DirConnect, "irc-1.../tls")
+	tr.Record(DirSend, "NICK user1")
+	tr.Record(DirRecv, ":irc-1.example.org 001 user1 :Welcome")
+	if err = tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "user1.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, err := ReadTranscript(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("read %d entries, want 3", len(entries))
+	}
+	for ii, e := range entries {
+		if e.Client != "user1" {
+			t.Errorf("entry %d is for %q", ii, e.Client)
+		}
+		if ii > 0 && e.Elapsed < entries[ii-1].Elapsed {
+			t.Errorf("entry %d went back in time", ii)
+		}
+	}
+	if e := entries[1]; e.Dir != DirSend || e.Text != "NICK user1" {
+		t.Errorf("entry 1 = %+v", e)
+	}
+}
+
+func TestReplayPattern(t *testing.T) {
+	cases := map[string]string{
+		":irc-1.example.org 001 user1 :Welcome":                `001 user1 :Welcome`,
+		"@time=2026-01-01T00:00:00Z :user2!u@h PRIVMSG #a :hi": `PRIVMSG #a :hi`,
+		"PING :irc-1.example.org":                              `PING :irc-1\.example\.org`,
+		":user2!u@h PRIVMSG user1 :costs $5":                   `PRIVMSG user1 :costs \x245`,
+	}
+	for text, want := range cases {
+		if got := replayPattern(text); got != want {
+			t.Errorf("replayPattern(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestWriteSkeleton(t *testing.T) {
+	at := func(ms int) time.Duration { return time.Duration(ms) * time.Millisecond }
+	entries := []TranscriptEntry{
+		{Client: "user1", Elapsed: at(1), Dir: DirConnect, Text: "irc-1..."},
+		{Client: "user1", Elapsed: at(2), Dir: DirSend, Text: "NICK user1"},
+		{Client: "user1", Elapsed: at(3), Dir: DirRecv, Text: "PING :123"},
+		{Client: "user1", Elapsed: at(4), Dir: DirSend, Text: "PONG :123"},
+		{Client: "user1", Elapsed: at(5), Dir: DirRecv, Text: ":irc-1 001 user1 :Hi"},
+		{Client: "user1", Elapsed: at(7), Dir: DirSend, Text: "JOIN #test"},
+		{Client: "user1", Elapsed: at(9), Dir: DirRecv, Text: ":user1!u@h JOIN #test"},
+		{Client: "user1", Elapsed: at(10), Dir: DirSend, Text: "PRIVMSG #test :$5"},
+		{Client: "user1", Elapsed: at(12), Dir: DirClose, Text: "EOF"},
+		// A second transcript's entries are merged by time.
+		{Client: "user2", Elapsed: at(6), Dir: DirConnect, Text: "irc-2..."},
+		{Client: "user2", Elapsed: at(8), Dir: DirRecv, Text: ":irc-2 001 user2 :Hi"},
+		{Client: "user2", Elapsed: at(11), Dir: DirSend, Text: "QUIT"},
+	}
+	want := `CLIENT user1 irc-1...
+EXPECT user1 :001 user1 :Hi
+CLIENT user2 irc-2...
+SEND user1 :JOIN #test
+EXPECT user2 :001 user2 :Hi
+EXPECT user1 :JOIN #test
+# SEND user1 :PRIVMSG #test :$5
+SEND user2 :QUIT
+# user1 closed: EOF
+`
+	sb := &strings.Builder{}
+	if err := WriteSkeleton(sb, entries); err != nil {
+		t.Fatal(err)
+	}
+	if got := sb.String(); got != want {
+		t.Errorf("skeleton:\n%s\nwant:\n%s", got, want)
+	}
+}
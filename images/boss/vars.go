@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// globals holds script-level variables, as set by SET and LET.
+var globals = make(map[string]string)
+
+// counters holds the values used by the `counter()` function.
+var counters = make(map[string]int)
+
+// nickChars lists the characters used by the `randnick()` function.
+// The first character of a nickname is drawn from the letters only.
+const nickChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// callFunc calls the function named `fn` with argument `arg` for the
+// client `c` (which may be nil).
+func callFunc(c *ClientConn, fn, arg string) (string, error) {
+	switch fn {
+	case "cap":
+		return funcCap(c, arg)
+	case "counter":
+		return funcCounter(c, arg)
+	case "lower":
+		return funcLower(c, arg)
+	case "randnick":
+		return funcRandNick(c, arg)
+	case "upper":
+		return funcUpper(c, arg)
+	default:
+		return "", fmt.Errorf("unknown function %s", fn)
+	}
+}
+
+// funcCap returns "1" if the client has the capability `arg` enabled,
+// or else "0".
+// Syntax: `${cap(<name>)}`
+func funcCap(c *ClientConn, arg string) (string, error) {
+	if c == nil {
+		return "", fmt.Errorf("cap(%s) needs a client", arg)
+	}
+	if c.HasCap(arg) {
+		return "1", nil
+	}
+	return "0", nil
+}
+
+// funcCounter increments the counter named `arg` and returns its value.
+// Syntax: `${counter(<name>)}`
+func funcCounter(_ *ClientConn, arg string) (string, error) {
+	counters[arg]++
+	return strconv.Itoa(counters[arg]), nil
+}
+
+// funcLower returns the value of `arg`, lower-cased using the IRC case
+// mapping of the client.
+// Syntax: `${lower(<variable>)}`
+func funcLower(c *ClientConn, arg string) (string, error) {
+	v, err := lookupVar(c, arg)
+	return IrcToLower(v, caseMapping(c)), err
+}
+
+// funcUpper returns the value of `arg`, upper-cased using the IRC case
+// mapping of the client.
+// Syntax: `${upper(<variable>)}`
+func funcUpper(c *ClientConn, arg string) (string, error) {
+	v, err := lookupVar(c, arg)
+	return IrcToUpper(v, caseMapping(c)), err
+}
+
+// funcRandNick returns a random nickname with `arg` characters, or 9
+// characters if `arg` is empty.
+// Syntax: `${randnick([<length>])}`
+func funcRandNick(_ *ClientConn, arg string) (string, error) {
+	n := 9
+	if arg != "" {
+		var err error
+		if n, err = strconv.Atoi(arg); err != nil || n < 1 {
+			return "", fmt.Errorf("invalid nickname length %q", arg)
+		}
+	}
+
+	nick := make([]byte, n)
+	nick[0] = nickChars[rand.Intn(52)]
+	for ii := 1; ii < n; ii++ {
+		nick[ii] = nickChars[rand.Intn(len(nickChars))]
+	}
+	return string(nick), nil
+}
+
+// isWord returns true if `s` is non-empty and only contains ASCII
+// letters, digits and underscores.
+func isWord(s string) bool {
+	for ii := 0; ii < len(s); ii++ {
+		ch := s[ii]
+		if !(ch == '_' || ('0' <= ch && ch <= '9') ||
+			('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z')) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// caseMapping returns the case mapping to use for client `c`.
+func caseMapping(c *ClientConn) string {
+	if c == nil || c.CaseMapping == "" {
+		return "rfc1459"
+	}
+	return c.CaseMapping
+}
+
+// lookupVar returns the value of the variable reference `name`, as
+// seen by client `c` (which is nil outside of a client's context).
+//
+// The supported forms are:
+//   - `<name>` for a client variable or else a global variable.
+//   - `<client>.<name>` for a variable of another client.
+//   - `<func>(<arg>)` to call a function; see callFunc().
+//   - `<ref>:-<default>` to use `<default>` if `<ref>` is unset or empty.
+func lookupVar(c *ClientConn, name string) (string, error) {
+	// Is it a function call?
+	fn, arg, found := strings.Cut(name, "(")
+	if found && isWord(fn) && strings.HasSuffix(arg, ")") {
+		return callFunc(c, fn, arg[:len(arg)-1])
+	}
+
+	// Is there a default value?
+	if ref, def, found := strings.Cut(name, ":-"); found {
+		if v, err := lookupVar(c, ref); err == nil && v != "" {
+			return v, nil
+		}
+		return def, nil
+	}
+
+	// Is it another client's variable?
+	if other, rest, found := strings.Cut(name, "."); found {
+		client, ok := clients[other]
+		if !ok {
+			return "", fmt.Errorf("unknown client %s in %s", other, name)
+		}
+		return lookupVar(client, rest)
+	}
+
+	// Is it a client variable?
+	if c != nil {
+		if v, ok := c.Lookup(name); ok {
+			return v, nil
+		}
+	}
+
+	// Is it a global variable?
+	if v, ok := globals[name]; ok {
+		return v, nil
+	}
+
+	return "", fmt.Errorf("unknown variable %s", name)
+}
+
+// expandGlobal expands variables in `text` outside of any client's
+// context.
+func expandGlobal(text string, mode ExpandMode) (string, error) {
+	return ExpandVars(text, mode, func(name string) (string, error) {
+		return lookupVar(nil, name)
+	})
+}
+
+// setVar assigns `value` to the variable named `name`, which is either
+// a global variable or `<client>.<name>` for a client variable.
+func setVar(name, value string) error {
+	if name == "" || strings.ContainsAny(name, "(){}:=$") {
+		return fmt.Errorf("invalid variable name %q", name)
+	}
+
+	other, rest, found := strings.Cut(name, ".")
+	if !found {
+		globals[name] = value
+		return nil
+	}
+
+	client, ok := clients[other]
+	if !ok {
+		return fmt.Errorf("unknown client %s in %s", other, name)
+	}
+	if rest == "me" || rest == "channel" || strings.Contains(rest, ".") {
+		return fmt.Errorf("cannot set %s", name)
+	}
+	client.vars[rest] = value
+	return nil
+}
+
+// doSet assigns a variable.
+// Syntax: `SET <name> :<value>`
+// Variables in `<value>` are expanded first.
+func doSet(args []string) {
+	if len(args) != 2 {
+		report.Errorf(lineno, "COMMAND SET :wrong number of arguments")
+		return
+	}
+	value, err := expandGlobal(args[1], ExpandText)
+	if err == nil {
+		err = setVar(args[0], value)
+	}
+	if err != nil {
+		report.Errorf(lineno, "COMMAND SET :%v", err)
+	}
+}
+
+// doLet assigns the result of an integer expression to a variable.
+// Syntax: `LET <name> :<expression>`
+// Variables in `<expression>` are expanded first, and the expression
+// may use `+`, `-`, `*`, `/`, `%` and parentheses.
+func doLet(args []string) {
+	if len(args) != 2 {
+		report.Errorf(lineno, "COMMAND LET :wrong number of arguments")
+		return
+	}
+	expr, err := expandGlobal(args[1], ExpandText)
+	if err != nil {
+		report.Errorf(lineno, "COMMAND LET :%v", err)
+		return
+	}
+	value, err := EvalInt(expr)
+	if err == nil {
+		err = setVar(args[0], strconv.FormatInt(value, 10))
+	}
+	if err != nil {
+		report.Errorf(lineno, "COMMAND LET :%v", err)
+	}
+}
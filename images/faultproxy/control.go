@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// ServeControl accepts control connections from `listener`.
+func (p *Proxy) ServeControl(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("accepting on control socket: %v", err)
+			return
+		}
+		go p.control(conn)
+	}
+}
+
+// control reads commands from `conn`, replying to each with a line that
+// starts with "OK" or "ERROR".
+func (p *Proxy) control(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		reply, err := p.Command(scanner.Text())
+		if err != nil {
+			reply = "ERROR " + err.Error()
+		}
+		if _, err = fmt.Fprintf(conn, "%s\r\n", reply); err != nil {
+			return
+		}
+	}
+}
+
+// Command executes the control command `line`:
+//   - `[up.|down.]<key>=<value> ...` sets faults,
+//   - `CLEAR` removes all faults and ends a split,
+//   - `RESET` resets all connections through the proxy,
+//   - `SPLIT` closes all connections through the proxy, and new ones
+//     until `CLEAR`, and
+//   - `SHOW` reports the current faults.
+func (p *Proxy) Command(line string) (string, error) {
+	log.Printf("control: %s", line)
+	words := strings.Fields(line)
+	if len(words) == 0 {
+		return "", fmt.Errorf("empty command")
+	}
+	switch words[0] {
+	case "CLEAR":
+		p.Clear()
+		return "OK", nil
+	case "RESET":
+		return fmt.Sprintf("OK %d", p.Reset()), nil
+	case "SPLIT":
+		return fmt.Sprintf("OK %d", p.Split()), nil
+	case "SHOW":
+		p.mu.Lock()
+		split := p.split
+		p.mu.Unlock()
+		return fmt.Sprintf("OK up %v; down %v; split=%s",
+			p.Faults(Up), p.Faults(Down), onOff(split)), nil
+	}
+
+	settings := make([]Setting, 0, len(words))
+	for _, word := range words {
+		s, err := ParseSetting(word)
+		if err != nil {
+			return "", err
+		}
+		settings = append(settings, s)
+	}
+	p.Apply(settings)
+	return "OK", nil
+}
@@ -0,0 +1,39 @@
+// faultproxy forwards TCP connections to a server, injecting faults such
+// as latency, bandwidth caps, stalls, dropped data, partial writes,
+// connection resets and splits under the control of a script.  It also
+// carries the server links that LINK names.
+//
+// Usage: faultproxy [-control <port>] <server> <port> [<port> ...]
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+)
+
+func main() {
+	controlPort := flag.String("control", "7000", "Port to accept control connections on")
+	flag.Parse()
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	p := NewProxy(flag.Arg(0))
+	for _, port := range flag.Args()[1:] {
+		listener, err := net.Listen("tcp", net.JoinHostPort("", port))
+		if err != nil {
+			log.Fatalf("failed to listen on port %s: %v", port, err)
+		}
+		go p.Serve(listener, port)
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort("", *controlPort))
+	if err != nil {
+		log.Fatalf("failed to listen on control port %s: %v", *controlPort, err)
+	}
+	log.Printf("forwarding %v to %s", flag.Args()[1:], p.Target)
+	p.ServeControl(listener)
+}
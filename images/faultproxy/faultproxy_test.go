@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSetting(t *testing.T) {
+	cases := []struct {
+		word string
+		dirs []Direction
+		err  bool
+	}{
+		{"latency=200ms", []Direction{Up, Down}, false},
+		{"down.rate=512", []Direction{Down}, false},
+		{"up.stall=on", []Direction{Up}, false},
+		{"partial=-1", nil, true},
+		{"latency=soon", nil, true},
+		{"jitter=1s", nil, true},
+		{"stall", nil, true},
+		{"up.drop=on", []Direction{Up}, false},
+	}
+	for _, c := range cases {
+		s, err := ParseSetting(c.word)
+		if (err != nil) != c.err {
+			t.Errorf("ParseSetting(%q) error = %v", c.word, err)
+			continue
+		}
+		if err == nil && len(s.Directions) != len(c.dirs) {
+			t.Errorf("ParseSetting(%q) directions = %v, want %v", c.word, s.Directions, c.dirs)
+		}
+	}
+}
+
+// startTestProxy starts a proxy on 127.0.0.1 in front of an echo server
+// on 127.0.0.2, using the same port.
+func startTestProxy(t *testing.T) (*Proxy, string) {
+	target, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("cannot listen on 127.0.0.2: %v", err)
+	}
+	t.Cleanup(func() { target.Close() })
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(target.Addr().String())
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Skipf("cannot listen on port %s: %v", port, err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	p := NewProxy("127.0.0.2")
+	go p.Serve(listener, port)
+	return p, listener.Addr().String()
+}
+
+// command runs a control command, failing the test if it fails.
+func command(t *testing.T, p *Proxy, line string) {
+	t.Helper()
+	if _, err := p.Command(line); err != nil {
+		t.Fatalf("%s: %v", line, err)
+	}
+}
+
+// echo sends `line` through `conn` and returns the reply, or an error
+// if none arrives within `timeout`.
+func echo(conn net.Conn, r *bufio.Reader, line string, timeout time.Duration) (string, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write([]byte(line + "\n")); err != nil {
+		return "", err
+	}
+	reply, err := r.ReadString('\n')
+	return strings.TrimSuffix(reply, "\n"), err
+}
+
+func TestProxyFaults(t *testing.T) {
+	p, addr := startTestProxy(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	if got, err := echo(conn, r, "hello", time.Second); got != "hello" {
+		t.Fatalf("echo = %q, %v; want hello", got, err)
+	}
+
+	// Latency applies in each direction.
+	command(t, p, "latency=100ms")
+	start := time.Now()
+	if got, err := echo(conn, r, "slow", time.Second); got != "slow" {
+		t.Fatalf("echo = %q, %v; want slow", got, err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("delayed echo took %v", elapsed)
+	}
+
+	// A rate limit of 100 bytes/second delays 50 bytes by about half a
+	// second.
+	command(t, p, "CLEAR")
+	command(t, p, "down.rate=100")
+	start = time.Now()
+	line := strings.Repeat("x", 49)
+	if got, err := echo(conn, r, line, 2*time.Second); got != line {
+		t.Fatalf("echo = %q, %v; want %q", got, err, line)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("rate-limited echo took %v", elapsed)
+	}
+
+	// Partial writes deliver the data in pieces.
+	command(t, p, "CLEAR")
+	command(t, p, "down.partial=2 down.gap=50ms")
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte("abcdef\n"))
+	buf := make([]byte, 16)
+	if n, err := r.Read(buf); n != 2 || err != nil {
+		t.Errorf("partial read got %q, %v", buf[:n], err)
+	}
+	if rest, err := r.ReadString('\n'); rest != "cdef\n" {
+		t.Errorf("rest of partial read = %q, %v", rest, err)
+	}
+
+	// A stall holds data until it is cleared.
+	command(t, p, "CLEAR")
+	command(t, p, "up.stall=on")
+	if got, err := echo(conn, r, "held", 200*time.Millisecond); err == nil {
+		t.Errorf("echo = %q while stalled", got)
+	}
+	command(t, p, "up.stall=off")
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if got, err := r.ReadString('\n'); got != "held\n" {
+		t.Errorf("after stall, read %q, %v", got, err)
+	}
+}
+
+func TestProxyReset(t *testing.T) {
+	p, addr := startTestProxy(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if got, err := echo(conn, r, "hello", time.Second); got != "hello" {
+		t.Fatalf("echo = %q, %v; want hello", got, err)
+	}
+
+	if reply, err := p.Command("RESET"); reply != "OK 1" {
+		t.Errorf("RESET = %q, %v", reply, err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err = r.ReadByte(); err == nil || errors.Is(err, io.EOF) {
+		t.Errorf("read after RESET got %v; want a reset", err)
+	}
+}
+
+func TestProxyDrop(t *testing.T) {
+	p, addr := startTestProxy(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// Dropped data never arrives, even after the drop ends.
+	command(t, p, "drop=on")
+	if got, err := echo(conn, r, "lost", 200*time.Millisecond); err == nil {
+		t.Errorf("echo = %q while dropping; want timeout", got)
+	}
+	command(t, p, "drop=off")
+	if got, err := echo(conn, r, "kept", time.Second); got != "kept" {
+		t.Errorf("echo = %q, %v; want kept", got, err)
+	}
+}
+
+func TestProxySplit(t *testing.T) {
+	p, addr := startTestProxy(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if got, err := echo(conn, r, "hello", time.Second); got != "hello" {
+		t.Fatalf("echo = %q, %v; want hello", got, err)
+	}
+
+	// Splitting closes the connection, and new ones.
+	if reply, err := p.Command("SPLIT"); reply != "OK 1" {
+		t.Errorf("SPLIT = %q, %v", reply, err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err = r.ReadByte(); err == nil {
+		t.Errorf("read succeeded after SPLIT")
+	}
+	conn2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	if got, err := echo(conn2, bufio.NewReader(conn2), "again", time.Second); err == nil {
+		t.Errorf("echo = %q after SPLIT; want error", got)
+	}
+
+	// Clearing the faults allows new connections.
+	command(t, p, "CLEAR")
+	conn3, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn3.Close()
+	if got, err := echo(conn3, bufio.NewReader(conn3), "healed", time.Second); got != "healed" {
+		t.Errorf("echo = %q, %v; want healed", got, err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Faults describes how the proxy mistreats data in one direction.
+type Faults struct {
+	// Latency is how long to hold data before forwarding it.
+	Latency time.Duration
+
+	// Rate limits how many bytes per second are forwarded, if positive.
+	Rate int
+
+	// Partial limits how many bytes are forwarded by each write, if
+	// positive.
+	Partial int
+
+	// Gap is how long to pause after each partial write.
+	Gap time.Duration
+
+	// Stall is true if forwarding is suspended.  Data that has been read
+	// is held until the stall ends.
+	Stall bool
+
+	// Drop is true if data is silently discarded, so the other side
+	// sees a stalled connection rather than a closed one.
+	Drop bool
+}
+
+// String formats `f` as settings that Set() accepts.
+func (f Faults) String() string {
+	return fmt.Sprintf("latency=%v rate=%d partial=%d gap=%v stall=%s drop=%s",
+		f.Latency, f.Rate, f.Partial, f.Gap, onOff(f.Stall), onOff(f.Drop))
+}
+
+// onOff formats `b` as "on" or "off".
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// Set changes the fault named `key` to `value`.
+func (f *Faults) Set(key, value string) error {
+	var err error
+	switch key {
+	case "latency":
+		f.Latency, err = time.ParseDuration(value)
+	case "rate":
+		f.Rate, err = parseCount(value)
+	case "partial":
+		f.Partial, err = parseCount(value)
+	case "gap":
+		f.Gap, err = time.ParseDuration(value)
+	case "stall":
+		f.Stall, err = parseOnOff(value)
+	case "drop":
+		f.Drop, err = parseOnOff(value)
+	default:
+		return errors.New("unknown fault " + key)
+	}
+	if err != nil {
+		return fmt.Errorf("bad value for %s: %v", key, err)
+	}
+	return nil
+}
+
+// parseCount parses a non-negative decimal integer.
+func parseCount(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err == nil && n < 0 {
+		err = errors.New("must not be negative")
+	}
+	return n, err
+}
+
+// parseOnOff parses "on", "off" or a boolean value.
+func parseOnOff(value string) (bool, error) {
+	switch value {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// Direction identifies which way data flows through the proxy.
+type Direction int
+
+const (
+	// Up is from the client to the server.
+	Up Direction = iota
+
+	// Down is from the server to the client.
+	Down
+)
+
+// String returns the name used for `d` in settings.
+func (d Direction) String() string {
+	if d == Up {
+		return "up"
+	}
+	return "down"
+}
+
+// Setting is a parsed `[up.|down.]<key>=<value>` word.
+type Setting struct {
+	// Directions lists the directions the setting applies to.
+	Directions []Direction
+
+	// Key names the fault.
+	Key string
+
+	// Value is the fault's new value.
+	Value string
+}
+
+// ParseSetting parses `word` as a setting.  Without an `up.` or `down.`
+// prefix, a setting applies in both directions.
+func ParseSetting(word string) (Setting, error) {
+	key, value, found := strings.Cut(word, "=")
+	if !found {
+		return Setting{}, errors.New("expected <key>=<value>, not " + word)
+	}
+	s := Setting{Directions: []Direction{Up, Down}, Key: key, Value: value}
+	if rest, ok := strings.CutPrefix(key, "up."); ok {
+		s.Directions, s.Key = []Direction{Up}, rest
+	} else if rest, ok := strings.CutPrefix(key, "down."); ok {
+		s.Directions, s.Key = []Direction{Down}, rest
+	}
+
+	// Check the value now, so a bad setting does not half-apply.
+	var f Faults
+	if err := f.Set(s.Key, s.Value); err != nil {
+		return Setting{}, err
+	}
+	return s, nil
+}
@@ -0,0 +1,3 @@
+module github.com/entrope/testnet/images/faultproxy
+
+go 1.20
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Proxy forwards connections to a server, applying faults that the
+// control socket sets.
+type Proxy struct {
+	// Target is the host name or address of the server.
+	Target string
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// changed is signaled when the faults change or a connection
+	// closes, to wake writers that are stalled.
+	changed *sync.Cond
+
+	// faults holds the faults for each Direction.
+	faults [2]Faults
+
+	// split is true if new connections are closed as soon as they are
+	// accepted.
+	split bool
+
+	// conns holds the open connections through the proxy.
+	conns map[*proxyConn]bool
+}
+
+// proxyConn is a client's connection through the proxy.
+type proxyConn struct {
+	// client and server are the two sides of the connection.
+	client, server net.Conn
+
+	// closed is true once the connection has been closed.  It is
+	// protected by the proxy's mu.
+	closed bool
+}
+
+// chunk is data read from one side of a connection, waiting to be
+// forwarded to the other.
+type chunk struct {
+	data []byte
+	due  time.Time
+}
+
+// NewProxy creates a proxy for `target`.
+func NewProxy(target string) *Proxy {
+	p := &Proxy{
+		Target: target,
+		conns:  make(map[*proxyConn]bool),
+	}
+	p.changed = sync.NewCond(&p.mu)
+	return p
+}
+
+// Serve accepts connections from `listener` and forwards them to the
+// same port on the target.
+func (p *Proxy) Serve(listener net.Listener, port string) {
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			log.Printf("accepting on port %s: %v", port, err)
+			return
+		}
+		go p.connect(client, port)
+	}
+}
+
+// connect connects `client` to `port` on the target, and forwards data
+// between them.
+func (p *Proxy) connect(client net.Conn, port string) {
+	p.mu.Lock()
+	split := p.split
+	p.mu.Unlock()
+	if split {
+		log.Printf("refused %v while split", client.RemoteAddr())
+		client.Close()
+		return
+	}
+
+	server, err := net.DialTimeout("tcp", net.JoinHostPort(p.Target, port), 10*time.Second)
+	if err != nil {
+		log.Printf("connecting %v to port %s: %v", client.RemoteAddr(), port, err)
+		client.Close()
+		return
+	}
+	log.Printf("connected %v to %v", client.RemoteAddr(), server.RemoteAddr())
+
+	pc := &proxyConn{client: client, server: server}
+	p.mu.Lock()
+	p.conns[pc] = true
+	p.mu.Unlock()
+	go p.pump(pc, server, client, Up)
+	go p.pump(pc, client, server, Down)
+}
+
+// pump forwards data from `src` to `dst`, applying the faults for `dir`.
+func (p *Proxy) pump(pc *proxyConn, dst, src net.Conn, dir Direction) {
+	chunks := make(chan chunk, 64)
+	defer close(chunks)
+	go func() {
+		for c := range chunks {
+			time.Sleep(time.Until(c.due))
+			if !p.write(pc, dst, c.data, dir) {
+				break
+			}
+		}
+		p.close(pc, false)
+		for range chunks {
+		}
+	}()
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			p.mu.Lock()
+			f := p.faults[dir]
+			p.mu.Unlock()
+			if !f.Drop {
+				data := append([]byte(nil), buf[:n]...)
+				chunks <- chunk{data: data, due: time.Now().Add(f.Latency)}
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// write writes `data` to `dst`, applying the stall, rate and partial
+// write faults for `dir`.  It returns false if the connection is closed.
+func (p *Proxy) write(pc *proxyConn, dst net.Conn, data []byte, dir Direction) bool {
+	for len(data) > 0 {
+		p.mu.Lock()
+		for p.faults[dir].Stall && !pc.closed {
+			p.changed.Wait()
+		}
+		f, closed := p.faults[dir], pc.closed
+		p.mu.Unlock()
+		if closed {
+			return false
+		}
+
+		n := len(data)
+		if f.Partial > 0 && n > f.Partial {
+			n = f.Partial
+		}
+		if f.Rate > 0 {
+			// Send at most a tenth of a second's worth at a time, so
+			// that the rate is smooth and a stall takes effect soon.
+			if limit := (f.Rate + 9) / 10; n > limit {
+				n = limit
+			}
+			time.Sleep(time.Duration(n) * time.Second / time.Duration(f.Rate))
+		}
+		if _, err := dst.Write(data[:n]); err != nil {
+			return false
+		}
+		data = data[n:]
+		if f.Partial > 0 && f.Gap > 0 && len(data) > 0 {
+			time.Sleep(f.Gap)
+		}
+	}
+	return true
+}
+
+// close closes both sides of `pc`.  If `reset` is true, it makes the
+// closes send a TCP reset rather than a FIN.
+func (p *Proxy) close(pc *proxyConn, reset bool) {
+	p.mu.Lock()
+	if pc.closed {
+		p.mu.Unlock()
+		return
+	}
+	pc.closed = true
+	delete(p.conns, pc)
+	p.changed.Broadcast()
+	p.mu.Unlock()
+
+	for _, conn := range []net.Conn{pc.client, pc.server} {
+		if tcp, ok := conn.(*net.TCPConn); ok && reset {
+			tcp.SetLinger(0)
+		}
+		conn.Close()
+	}
+	log.Printf("closed %v (reset=%v)", pc.client.RemoteAddr(), reset)
+}
+
+// Reset closes every connection through the proxy with a TCP reset, and
+// returns how many there were.
+func (p *Proxy) Reset() int {
+	return p.closeAll(true)
+}
+
+// Split closes every connection through the proxy, and closes new ones
+// until the faults are cleared.  It returns how many connections there
+// were.
+func (p *Proxy) Split() int {
+	p.mu.Lock()
+	p.split = true
+	p.mu.Unlock()
+	return p.closeAll(false)
+}
+
+// closeAll closes every connection through the proxy, as close() does,
+// and returns how many there were.
+func (p *Proxy) closeAll(reset bool) int {
+	p.mu.Lock()
+	conns := make([]*proxyConn, 0, len(p.conns))
+	for pc := range p.conns {
+		conns = append(conns, pc)
+	}
+	p.mu.Unlock()
+	for _, pc := range conns {
+		p.close(pc, reset)
+	}
+	return len(conns)
+}
+
+// Apply applies `settings` to the proxy's faults.
+func (p *Proxy) Apply(settings []Setting) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, s := range settings {
+		for _, dir := range s.Directions {
+			// ParseSetting() already checked the value.
+			_ = p.faults[dir].Set(s.Key, s.Value)
+		}
+	}
+	p.changed.Broadcast()
+}
+
+// Clear removes all of the proxy's faults, and ends a split.
+func (p *Proxy) Clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.faults = [2]Faults{}
+	p.split = false
+	p.changed.Broadcast()
+}
+
+// Faults returns the proxy's current faults for `dir`.
+func (p *Proxy) Faults(dir Direction) Faults {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.faults[dir]
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"math/big"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// tlsDir is the directory (within the script directory) where we write
+// certificates and keys.
+const tlsDir = "tls"
+
+// serverTLSDir is where servers find the testnet CA and their own
+// certificate and key.
+const serverTLSDir = "/etc/testnet/tls"
+
+// bossTLSDir is where `boss` finds the testnet CA and the clients'
+// certificates.
+const bossTLSDir = "/etc/boss/tls"
+
+// certEpoch and certExpiry bound the validity of every certificate, so
+// that certificates do not depend on when `orchestrate` runs.
+var certEpoch = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+var certExpiry = time.Date(2100, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// certKey holds a certificate and its private key.
+type certKey struct {
+	// Der is the DER encoding of the certificate.
+	Der []byte
+
+	// Cert is the parsed certificate.
+	Cert *x509.Certificate
+
+	// Key is the certificate's private key.
+	Key *ecdsa.PrivateKey
+}
+
+// testnetCA is the certificate authority for this run, once created.
+var testnetCA *certKey
+
+// certs maps names to their certificates, once created.
+var certs = make(map[string]*certKey)
+
+// deriveBytes derives `n` pseudorandom bytes from the orchestrator
+// global key plus `salt`.
+func deriveBytes(salt string, n int) []byte {
+	return pbkdf2.Key(seed, []byte(salt), 4096, n, sha256.New)
+}
+
+// deriveKey derives an ECDSA P-256 key from the orchestrator global
+// key plus `salt`.
+// We use P-256 rather than Ed25519 because every TLS library that the
+// servers use supports it.
+func deriveKey(salt string) *ecdsa.PrivateKey {
+	// Reduce a value 64 bits longer than the curve's order into the
+	// range [1, N-1], as in FIPS 186-4 section B.4.1, so that the bias
+	// is negligible.
+	order := elliptic.P256().Params().N
+	one := big.NewInt(1)
+	d := new(big.Int).SetBytes(deriveBytes(salt, 40))
+	d.Mod(d, new(big.Int).Sub(order, one))
+	d.Add(d, one)
+
+	key, err := ecdh.P256().NewPrivateKey(d.FillBytes(make([]byte, 32)))
+	if err != nil {
+		log.Fatalf("failed to derive key for %s: %v", salt, err)
+	}
+	point := key.PublicKey().Bytes() // 0x04 || X || Y
+	return &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(point[1:33]),
+			Y:     new(big.Int).SetBytes(point[33:]),
+		},
+		D: d,
+	}
+}
+
+// makeCert creates a certificate for `name`, signed by `parent` (or
+// self-signed if `parent` is nil, as for the CA).
+// The key and serial number are derived from the global key, and the
+// signature is deterministic (RFC 6979), so the same seed and addresses
+// always give the same certificate.
+func makeCert(name string, parent *certKey, addrs []string) *certKey {
+	key := deriveKey("tls key " + name)
+	serial := new(big.Int).SetBytes(deriveBytes("tls serial "+name, 16))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    certEpoch,
+		NotAfter:     certExpiry,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth,
+		},
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		template.ExtKeyUsage = nil
+	} else if strings.ContainsRune(name, '.') {
+		template.DNSNames = []string{name}
+	}
+	for _, text := range addrs {
+		if addr, err := netip.ParseAddr(text); err == nil {
+			template.IPAddresses = append(template.IPAddresses, addr.AsSlice())
+		}
+	}
+
+	// Sign the certificate.  A nil random source makes ECDSA use
+	// deterministic signatures.
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.Cert, parent.Key
+	}
+	der, err := x509.CreateCertificate(nil, template, parentCert,
+		key.Public(), parentKey)
+	if err != nil {
+		log.Fatalf("failed to create certificate for %s: %v", name, err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		log.Fatalf("failed to parse certificate for %s: %v", name, err)
+	}
+	return &certKey{Der: der, Cert: cert, Key: key}
+}
+
+// CertPEM returns the PEM encoding of the certificate.
+func (ck *certKey) CertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ck.Der})
+}
+
+// KeyPEM returns the PEM encoding of the private key, in PKCS #8 form.
+func (ck *certKey) KeyPEM() []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(ck.Key)
+	if err != nil {
+		log.Fatalf("failed to encode private key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the certificate, as
+// lower-case hex digits.
+func (ck *certKey) Fingerprint() string {
+	sum := sha256.Sum256(ck.Der)
+	return hex.EncodeToString(sum[:])
+}
+
+// caCert returns the testnet CA, creating it if needed.
+func caCert() *certKey {
+	if testnetCA == nil {
+		testnetCA = makeCert("Testnet CA", nil, nil)
+	}
+	return testnetCA
+}
+
+// certFor returns the certificate for `name`, creating it if needed.
+// If `name` is a server, the certificate also lists its addresses.
+func certFor(name string) *certKey {
+	name = replaceSuffix(name)
+	if ck, ok := certs[name]; ok {
+		return ck
+	}
+	var addrs []string
+	if strings.ContainsRune(name, '.') {
+		for _, ha := range hostAddrs[name] {
+			for _, addr := range ha.Addrs {
+				addrs = append(addrs, addr.String())
+			}
+		}
+	}
+	ck := makeCert(name, caCert(), addrs)
+	certs[name] = ck
+	return ck
+}
+
+// addFileConfig writes `data` to `file` in the script directory, and
+// mounts it at `target` in the service `svcName`, unless the service
+// already has a config at `target`.
+func addFileConfig(svcName string, file string, data []byte, target string) {
+	svc := compose.Services[svcName]
+	for _, cfg := range svc.Configs {
+		if cfg.Target == target {
+			return
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), dirMode); err != nil {
+		log.Fatalf("failed to create directory for %s: %v", file, err)
+	}
+	if err := os.WriteFile(file, data, fileMode); err != nil {
+		log.Fatalf("failed to write %s: %v", file, err)
+	}
+
+	cfgName := strings.ReplaceAll(filepath.ToSlash(file), "/", "-")
+	cfgName = strings.ReplaceAll(cfgName, ".", "_")
+	compose.Configs[cfgName] = &ConfigOrSecret{
+		File: file,
+	}
+	svc.Configs = append(svc.Configs, ServiceConfig{
+		Source: cfgName,
+		Target: target,
+	})
+}
+
+// writeCerts creates a certificate for each server and client, and
+// passes them to the containers that use them: each server gets the CA
+// plus its own certificate and key, and `boss` gets the CA plus every
+// client's certificate and key (in one file per client).
+// Fault proxies only forward bytes, so they get nothing.
+func writeCerts() {
+	caPEM := caCert().CertPEM()
+	for _, name := range slices.Sorted(maps.Keys(containers)) {
+		host := containers[name]
+		_, isLink := linkProxies[name]
+		_, isProxy := serverProxies[name]
+		switch {
+		case isLink || isProxy:
+			continue
+		case name == "boss":
+			addFileConfig(name, filepath.Join(tlsDir, "ca.pem"), caPEM,
+				bossTLSDir+"/ca.pem")
+		case strings.ContainsRune(name, '.'):
+			ck := certFor(name)
+			addFileConfig(name, filepath.Join(tlsDir, "ca.pem"), caPEM,
+				serverTLSDir+"/ca.pem")
+			addFileConfig(name, filepath.Join(tlsDir, name+".crt"), ck.CertPEM(),
+				serverTLSDir+"/cert.pem")
+			addFileConfig(name, filepath.Join(tlsDir, name+".key"), ck.KeyPEM(),
+				serverTLSDir+"/key.pem")
+		default:
+			ck := certFor(name)
+			pemText := append(ck.CertPEM(), ck.KeyPEM()...)
+			addFileConfig(host, filepath.Join(tlsDir, name+".pem"), pemText,
+				bossTLSDir+"/"+name+".pem")
+		}
+	}
+}
+
+// fingerprints maps each server and client name to its certificate's
+// fingerprint.
+func fingerprints() map[string]string {
+	fps := make(map[string]string, len(certs))
+	for name, ck := range certs {
+		fps[name] = ck.Fingerprint()
+	}
+	return fps
+}
+
+// templateHost checks that `host` names a container, for the template
+// functions that write files.
+// `names` optionally gives the name of the key or certificate, which
+// otherwise defaults to the host's name.
+func templateHost(host string, names []string) (string, string, error) {
+	host = replaceSuffix(host)
+	if _, ok := containers[host]; !ok {
+		return "", "", fmt.Errorf("unknown container %s", host)
+	}
+	host = containers[host]
+	switch len(names) {
+	case 0:
+		return host, host, nil
+	case 1:
+		return host, replaceSuffix(names[0]), nil
+	}
+	return "", "", errors.New("expected a host and at most one name")
+}
+
+// tmplTLSCert implements the `tlsCert` template function.
+// `{{ tlsCert <host> [<name>] }}` passes the certificate for `<name>`
+// (or `<host>`) to `<host>`, and gives its path there.
+func tmplTLSCert(host string, names ...string) (string, error) {
+	host, name, err := templateHost(host, names)
+	if err != nil {
+		return "", err
+	}
+	target := serverTLSDir + "/" + name + ".crt"
+	addFileConfig(host, filepath.Join(tlsDir, name+".crt"),
+		certFor(name).CertPEM(), target)
+	return target, nil
+}
+
+// tmplTLSKey implements the `tlsKey` template function.
+// `{{ tlsKey <host> [<name>] }}` passes the private key for `<name>`
+// (or `<host>`) to `<host>`, and gives its path there.
+func tmplTLSKey(host string, names ...string) (string, error) {
+	host, name, err := templateHost(host, names)
+	if err != nil {
+		return "", err
+	}
+	target := serverTLSDir + "/" + name + ".key"
+	addFileConfig(host, filepath.Join(tlsDir, name+".key"),
+		certFor(name).KeyPEM(), target)
+	return target, nil
+}
+
+// tmplCertFingerprint implements the `certFingerprint` template function.
+// `{{ certFingerprint <name> }}` gives the SHA-256 fingerprint of the
+// certificate for `<name>`.
+func tmplCertFingerprint(name string) string {
+	return certFor(name).Fingerprint()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// setTestSeed sets the orchestrator global key, and forgets any
+// certificates derived from the old key until the test ends.
+func setTestSeed(t *testing.T, s string) {
+	oldSeed, oldCA, oldCerts := seed, testnetCA, certs
+	t.Cleanup(func() { seed, testnetCA, certs = oldSeed, oldCA, oldCerts })
+	seed, testnetCA, certs = []byte(s), nil, make(map[string]*certKey)
+}
+
+// testCertAddrs maps the names in the certificate tests to their
+// addresses.
+var testCertAddrs = map[string][]string{
+	"irc-1.example.org": {"10.1.2.2", "fd00::2"},
+	"user1":             nil,
+}
+
+// makeTestCerts derives the testnet CA and the certificates for
+// testCertAddrs from the global key.
+func makeTestCerts() (*certKey, map[string]*certKey) {
+	ca := makeCert("Testnet CA", nil, nil)
+	cks := make(map[string]*certKey)
+	for name, addrs := range testCertAddrs {
+		cks[name] = makeCert(name, ca, addrs)
+	}
+	return ca, cks
+}
+
+func TestCertDeterministic(t *testing.T) {
+	// Derive the certificates twice from each of two seeds.
+	derive := func(s string) map[string][]byte {
+		setTestSeed(t, s)
+		ca, cks := makeTestCerts()
+		pems := map[string][]byte{"ca": ca.CertPEM()}
+		for name, ck := range cks {
+			pems[name] = append(ck.CertPEM(), ck.KeyPEM()...)
+		}
+		return pems
+	}
+	first, again, other := derive("seed one"), derive("seed one"), derive("seed two")
+	for name, pemText := range first {
+		if !bytes.Equal(pemText, again[name]) {
+			t.Errorf("%s differs with the same seed", name)
+		}
+		if bytes.Equal(pemText, other[name]) {
+			t.Errorf("%s is the same with another seed", name)
+		}
+	}
+
+	// Each certificate has its own key and chains to the CA.
+	setTestSeed(t, "seed one")
+	ca, cks := makeTestCerts()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	fps := make(map[string]bool)
+	for name, ck := range cks {
+		opts := x509.VerifyOptions{
+			Roots:       roots,
+			CurrentTime: certEpoch.AddDate(1, 0, 0),
+			KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}
+		if strings.ContainsRune(name, '.') {
+			opts.DNSName = name
+		}
+		if _, err := ck.Cert.Verify(opts); err != nil {
+			t.Errorf("certificate for %s does not verify: %v", name, err)
+		}
+		fps[ck.Fingerprint()] = true
+
+		block, _ := pem.Decode(ck.KeyPEM())
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			t.Fatalf("key for %s does not parse: %v", name, err)
+		}
+		pub, err := x509.MarshalPKIXPublicKey(key.(crypto.Signer).Public())
+		if err != nil || !bytes.Equal(pub, ck.Cert.RawSubjectPublicKeyInfo) {
+			t.Errorf("key for %s does not match its certificate", name)
+		}
+	}
+	if len(fps) != len(cks) {
+		t.Errorf("certificates share fingerprints")
+	}
+
+	ips := cks["irc-1.example.org"].Cert.IPAddresses
+	if len(ips) != 2 || ips[0].String() != "10.1.2.2" || ips[1].String() != "fd00::2" {
+		t.Errorf("irc-1.example.org has IP addresses %v", ips)
+	}
+	if ck := cks["user1"]; len(ck.Cert.DNSNames) != 0 || len(ck.Cert.IPAddresses) != 0 {
+		t.Errorf("user1 has names %v and addresses %v",
+			ck.Cert.DNSNames, ck.Cert.IPAddresses)
+	}
+}
+
+func TestSSHKeyDeterministic(t *testing.T) {
+	setTestSeed(t, "seed one")
+	key := sshPrivatePEM(sshKeyFor("irc-1.example.org"), "irc-1.example.org")
+	if again := sshPrivatePEM(sshKeyFor("irc-1.example.org"), "irc-1.example.org"); !bytes.Equal(key, again) {
+		t.Errorf("SSH key differs with the same seed")
+	}
+	if other := sshPrivatePEM(sshKeyFor("irc-2.example.org"), "irc-2.example.org"); bytes.Equal(key, other) {
+		t.Errorf("SSH keys are the same for two names")
+	}
+	pub := tmplSSHPublicKey("irc-1.example.org")
+	setTestSeed(t, "seed two")
+	if other := tmplSSHPublicKey("irc-1.example.org"); other == pub {
+		t.Errorf("SSH key is the same with another seed")
+	}
+
+	// The public key line holds the same blob as the private key.
+	fields := strings.Fields(pub)
+	if len(fields) != 3 || fields[0] != "ssh-ed25519" || fields[2] != "irc-1.example.org" {
+		t.Fatalf("tmplSSHPublicKey() = %q", pub)
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(key)
+	if block == nil || block.Type != "OPENSSH PRIVATE KEY" {
+		t.Fatalf("sshPrivatePEM() = %q", key)
+	}
+	if !bytes.HasPrefix(block.Bytes, []byte("openssh-key-v1\x00")) ||
+		!bytes.Contains(block.Bytes, appendSSHString(nil, blob)) {
+		t.Errorf("private key does not hold the public key %s", fields[1])
+	}
+}
+
+func TestWriteCerts(t *testing.T) {
+	newTestCompose(t)
+	setTestSeed(t, "seed one")
+	t.Chdir(t.TempDir())
+	for _, name := range []string{"boss", "irc-1.example.org", "irc-2.example.org",
+		"proxy.example.org", linkHost("irc-1.example.org", "irc-2.example.org")} {
+		addTestService(name)
+	}
+	containers["user1"] = "boss"
+	serverProxies["proxy.example.org"] = struct{}{}
+	linkProxies[linkHost("irc-1.example.org", "irc-2.example.org")] = struct{}{}
+
+	writeCerts()
+	entries, err := os.ReadDir(tlsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.Name())
+	}
+	want := []string{"ca.pem", "irc-1.example.org.crt", "irc-1.example.org.key",
+		"irc-2.example.org.crt", "irc-2.example.org.key", "user1.pem"}
+	if !slices.Equal(got, want) {
+		t.Errorf("%s holds %v, want %v", tlsDir, got, want)
+	}
+	for name := range linkProxies {
+		if cfgs := compose.Services[name].Configs; len(cfgs) != 0 {
+			t.Errorf("%s has configs %+v", name, cfgs)
+		}
+	}
+	for name := range serverProxies {
+		if cfgs := compose.Services[name].Configs; len(cfgs) != 0 {
+			t.Errorf("%s has configs %+v", name, cfgs)
+		}
+	}
+}
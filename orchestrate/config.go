@@ -71,12 +71,22 @@ type Network struct {
 
 // Service describes a container instance within the application.
 type Service struct {
+	// Command overrides the image's default command.
+	Command []string `yaml:",omitempty"`
+
 	// Configs lists the configurations used by the service.
 	Configs []ServiceConfig `yaml:",omitempty"`
 
 	// ContainerName indicates what container to use for the service.
 	ContainerName string `yaml:"container_name,omitempty"`
 
+	// DNS lists the DNS servers for the service to use, rather than the
+	// container engine's.
+	DNS []string `yaml:"dns,omitempty"`
+
+	// Environment holds environment variables for the service.
+	Environment map[string]string `yaml:",omitempty"`
+
 	// Extends is used to inherit common values so they are not repeated.
 	Extends Extends `yaml:",omitempty"`
 
@@ -100,6 +110,10 @@ type Service struct {
 
 	// Sysctls is a list of sysctl values to override.
 	Sysctls map[string]string
+
+	// Volumes lists host paths to mount in the container, in the short
+	// `<host>:<container>` syntax.
+	Volumes []string `yaml:",omitempty"`
 }
 
 // ServiceConfig describes the "long" syntax for a config.
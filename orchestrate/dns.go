@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// bossHostsFile is where boss reads the names and addresses for its DNS
+// server.
+const bossHostsFile = "/etc/boss/dns.hosts"
+
+// dnsEnabled is true if the script uses DNS, so boss should be the DNS
+// server for the other services.
+var dnsEnabled bool
+
+// dnsNames maps the hosts that DNS and DNSBL commands name to the first
+// command that names each one.  A script can name a client before its
+// CLIENT command, so setupDNS checks these names.
+var dnsNames = map[string]string{}
+
+// cmdDNS handles the DNS script command, which makes boss answer DNS
+// queries for the testnet.
+func cmdDNS(words []string) error {
+	if len(words) < 2 || len(words) > 3 {
+		return errors.New("expected DNS <host> <mode> [<argument>]")
+	}
+	addDNSName(replaceSuffix(words[0]), "DNS")
+	return nil
+}
+
+// cmdDNSBL handles the DNSBL script command, which lists a client in
+// boss's DNS blocklist.
+func cmdDNSBL(words []string) error {
+	switch {
+	case len(words) == 3 && words[0] == "LIST":
+	case len(words) == 2 && words[0] == "UNLIST":
+	default:
+		return errors.New("expected DNSBL LIST <client> <code> or DNSBL UNLIST <client>")
+	}
+	addDNSName(words[1], "DNSBL")
+	return nil
+}
+
+// addDNSName records that the command `cmd` names the host `name`, and
+// enables boss's DNS server.
+func addDNSName(name, cmd string) {
+	if _, ok := dnsNames[name]; !ok {
+		dnsNames[name] = cmd
+	}
+	dnsEnabled = true
+}
+
+// dnsName returns the DNS name of the server, service or client `name`.
+// Clients' names get the SUFFIX (or "testnet") as a domain.
+func dnsName(name string) string {
+	if strings.ContainsRune(name, '.') {
+		return name
+	}
+	if suffix == "" {
+		return name + ".testnet"
+	}
+	return name + "." + suffix
+}
+
+// setupDNS writes the hosts file for boss's DNS server, and makes the
+// other services use that DNS server.
+func setupDNS() {
+	for name, cmd := range dnsNames {
+		if _, ok := hostAddrs[name]; !ok {
+			fmt.Printf("ERROR (%s): no client or server is named %s\n", cmd, name)
+		}
+	}
+
+	// Every service needs an address for boss on its first network.
+	var services []string
+	for name := range compose.Services {
+		if name != "boss" {
+			services = append(services, name)
+		}
+	}
+	sort.Strings(services)
+	for _, name := range services {
+		network := networksOf(name)[0]
+		if err := attachNetwork("boss", network); err != nil {
+			log.Fatalf("failed to give boss an address for DNS: %v", err)
+		}
+		compose.Services[name].DNS = []string{serviceAddr("boss", network)}
+	}
+
+	// List each address's names.
+	names := make(map[netip.Addr][]string)
+	var addrs []netip.Addr
+	for name, has := range hostAddrs {
+		for _, ha := range has {
+			for _, addr := range ha.Addrs {
+				if names[addr] == nil {
+					addrs = append(addrs, addr)
+				}
+				names[addr] = append(names[addr], name)
+			}
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Less(addrs[j]) })
+
+	// Write them in /etc/hosts format, with a line for each host, so
+	// that boss can tell hosts that share an address apart.
+	sb := &strings.Builder{}
+	for _, addr := range addrs {
+		sort.Strings(names[addr])
+		for _, name := range names[addr] {
+			fmt.Fprintf(sb, "%s %s", addr, dnsName(name))
+			if dnsName(name) != name {
+				fmt.Fprintf(sb, " %s", name)
+			}
+			sb.WriteString("\n")
+		}
+	}
+	if err := os.WriteFile("dns.hosts", []byte(sb.String()), fileMode); err != nil {
+		log.Fatalf("failed to write dns.hosts: %v", err)
+	}
+	compose.Configs["dns.hosts"] = &ConfigOrSecret{
+		File: "dns.hosts",
+	}
+	boss := compose.Services["boss"]
+	boss.Configs = append(boss.Configs, ServiceConfig{
+		Source: "dns.hosts",
+		Target: bossHostsFile,
+	})
+}
@@ -1,7 +1,7 @@
 module github.com/entrope/testnet/orchestrate
 
-go 1.23
+go 1.24
 
 require gopkg.in/yaml.v3 v3.0.1
 
-require golang.org/x/crypto v0.28.0 // indirect
+require golang.org/x/crypto v0.28.0
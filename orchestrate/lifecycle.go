@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var engineFlag = flag.String("engine", "",
+	"Container engine API socket to give boss for RESTART etc. (default depends on -tool); "+
+		"this gives boss root-equivalent control of the engine")
+
+// bossEngineSocket is where boss finds the container engine's socket.
+const bossEngineSocket = "/run/boss/engine.sock"
+
+// engineMounted is true once boss has been given the container engine's
+// socket.
+var engineMounted bool
+
+// engineSocket returns the path of the container engine's API socket on
+// the host.
+func engineSocket() string {
+	if *engineFlag != "" {
+		return *engineFlag
+	}
+	if filepath.Base(*toolName) == "docker" {
+		return "/var/run/docker.sock"
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "podman", "podman.sock")
+	}
+	return "/run/podman/podman.sock"
+}
+
+// cmdContainer returns a handler for the KILL, RECONFIG, REHASH, RESTART
+// or START script command with the syntax `usage`, which boss carries
+// out through the container engine's API.
+func cmdContainer(usage string) func([]string) error {
+	// Optional arguments are in brackets.
+	params := strings.Fields(usage)[1:]
+	required := len(params) - strings.Count(usage, "[")
+	return func(words []string) error {
+		if len(words) < required || len(words) > len(params) {
+			return errors.New("expected " + usage)
+		}
+		server := replaceSuffix(words[0])
+		if _, ok := containers[server]; !ok || !strings.ContainsAny(server, ".") {
+			return errors.New("no existing server is named " + server)
+		}
+
+		// Give boss access to the container engine.  This lets boss
+		// control any container, but it only acts on this project's.
+		if !engineMounted {
+			boss := compose.Services["boss"]
+			if boss.Environment == nil {
+				boss.Environment = make(map[string]string)
+			}
+			boss.Environment["TESTNET_PROJECT"] = composeProject()
+			boss.Volumes = append(boss.Volumes, engineSocket()+":"+bossEngineSocket)
+			engineMounted = true
+		}
+		return nil
+	}
+}
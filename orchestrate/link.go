@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// linkHost returns the host name of the proxy for the server link from
+// `from` to `to`.  This must match boss's linkHost().
+func linkHost(from, to string) string {
+	return "link-" + from + "-" + to
+}
+
+// defaultLinkPort is the port that servers accept links on, unless a
+// LINK command says otherwise.
+const defaultLinkPort = "4400"
+
+// linkProxies holds the names of the fault proxies that LINK commands
+// create.
+var linkProxies = stringSet{}
+
+// cmdLink handles the LINK script command, which puts a fault proxy
+// between two servers so the script can break their link.
+func cmdLink(words []string) error {
+	if len(words) != 2 {
+		return errors.New("expected LINK <from> <to>[:<port>]")
+	}
+	from := replaceSuffix(words[0])
+	to, port, found := strings.Cut(words[1], ":")
+	to = replaceSuffix(to)
+	if !found {
+		port = defaultLinkPort
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return errors.New("invalid port " + port)
+	}
+	if port == faultControlPort {
+		return errors.New("port " + port + " is the proxy's control port")
+	}
+	for _, name := range []string{from, to} {
+		if !strings.ContainsAny(name, ".") {
+			return errors.New("server names must contain a dot")
+		}
+		if _, ok := containers[name]; !ok {
+			return errors.New("no existing server is named " + name)
+		}
+	}
+	name := linkHost(from, to)
+	if _, ok := hostAddrs[name]; ok {
+		return fmt.Errorf("already have a link from %s to %s", from, to)
+	}
+
+	// The proxy needs an address on a network that both servers are on,
+	// and boss must be able to reach its control port.
+	toNetworks := networksOf(to)
+	for _, network := range networksOf(from) {
+		if !slices.Contains(toNetworks, network) {
+			continue
+		}
+		if err := makeService(name, "faultproxy", []string{network}); err != nil {
+			return err
+		}
+		svc := compose.Services[name]
+		svc.Build = "../../images/faultproxy"
+		svc.Command = []string{"-control", faultControlPort, to, port}
+		linkProxies[name] = struct{}{}
+		return attachNetwork("boss", network)
+	}
+	return fmt.Errorf("%s and %s share no network", from, to)
+}
+
+// tmplLink implements the `link` template function.
+// `{{ link <from> <to> }}` gives the address of the proxy for the link
+// from `<from>` to `<to>`.
+func tmplLink(from, to string) (string, error) {
+	from, to = replaceSuffix(from), replaceSuffix(to)
+	addr := serviceAddr(linkHost(from, to), "")
+	if addr == "" {
+		return "", fmt.Errorf("no LINK from %s to %s", from, to)
+	}
+	return addr, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+)
+
+// defaultNetwork names the network that is made from `-cidr` (and
+// `-cidr6`), and that servers and clients use unless told otherwise.
+const defaultNetwork = "inner"
+
+// testNetwork is a network within the Compose application, and the state
+// of assigning addresses from it.
+type testNetwork struct {
+	// prefixes holds the network's address ranges: an IPv4 range, an
+	// IPv6 range, or an IPv4 range then an IPv6 range.
+	prefixes []netip.Prefix
+
+	// next holds the next address to assign from each range.
+	next []netip.Addr
+}
+
+// testNetworks maps network names to their definitions.
+var testNetworks = make(map[string]*testNetwork)
+
+// hostAddr is a host's addresses on one network.
+type hostAddr struct {
+	// Network names the network.
+	Network string
+
+	// Addrs holds one address from each of the network's ranges.
+	Addrs []netip.Addr
+}
+
+// hostAddrs maps server, service and client names to their addresses,
+// in the order that they joined networks.
+var hostAddrs = make(map[string][]hostAddr)
+
+// addNetwork defines the network `name` with the address ranges
+// `prefixes`.
+func addNetwork(name string, prefixes []netip.Prefix) error {
+	if _, ok := testNetworks[name]; ok {
+		return errors.New("already have a network named " + name)
+	}
+	switch {
+	case len(prefixes) == 1:
+	case len(prefixes) == 2 && prefixes[0].Addr().Is4() && prefixes[1].Addr().Is6():
+	default:
+		return errors.New("a dual-stack network needs an IPv4 range then an IPv6 range")
+	}
+
+	// Addresses start after the network's own address and the gateway,
+	// which Podman uses for DNS etc.
+	tn := &testNetwork{}
+	ipam := IPAM{Driver: "default"}
+	enableIPv6 := false
+	for _, prefix := range prefixes {
+		prefix = prefix.Masked()
+		tn.prefixes = append(tn.prefixes, prefix)
+		tn.next = append(tn.next, prefix.Addr().Next().Next())
+		ipam.Config = append(ipam.Config, IPAMConfig{Subnet: prefix})
+		enableIPv6 = enableIPv6 || prefix.Addr().Is6()
+	}
+	testNetworks[name] = tn
+	compose.Networks[name] = &Network{
+		Attachable: false,
+		EnableIPv6: enableIPv6,
+		Internal:   true,
+		IPAM:       ipam,
+	}
+	return nil
+}
+
+// alloc assigns the next address from each of the network's ranges.
+func (tn *testNetwork) alloc() ([]netip.Addr, error) {
+	addrs := make([]netip.Addr, len(tn.next))
+	for ii, addr := range tn.next {
+		if !tn.prefixes[ii].Contains(addr) {
+			return nil, fmt.Errorf("no addresses left in %v", tn.prefixes[ii])
+		}
+		addrs[ii] = addr
+		tn.next[ii] = addr.Next()
+	}
+	return addrs, nil
+}
+
+// attachNetwork connects the service `svcName` to the network `name`, if
+// it is not already connected, giving it an address from each of the
+// network's ranges.
+func attachNetwork(svcName string, name string) error {
+	svc := compose.Services[svcName]
+	if svc.Networks[name] != nil {
+		return nil
+	}
+	tn := testNetworks[name]
+	if tn == nil {
+		return errors.New("no network is named " + name)
+	}
+
+	addrs, err := tn.alloc()
+	if err != nil {
+		return err
+	}
+	svcNetwork := &ServiceNetwork{}
+	for _, addr := range addrs {
+		if addr.Is4() {
+			svcNetwork.IPv4Address = addr.String()
+		} else {
+			svcNetwork.IPv6Address = addr.String()
+		}
+	}
+	svc.Networks[name] = svcNetwork
+	hostAddrs[svcName] = append(hostAddrs[svcName], hostAddr{name, addrs})
+	return nil
+}
+
+// networksOf lists the networks that `name` has addresses on.
+func networksOf(name string) []string {
+	var names []string
+	for _, ha := range hostAddrs[name] {
+		names = append(names, ha.Network)
+	}
+	return names
+}
+
+// serviceAddr returns the primary IP address of the server, service or
+// client `name` on the network `network`, or on the first network it
+// joined if `network` is empty.
+// The primary address is the IPv4 address on a dual-stack network.
+// It returns the empty string if there is no such address.
+func serviceAddr(name string, network string) string {
+	for _, ha := range hostAddrs[name] {
+		if network == "" || ha.Network == network {
+			return ha.Addrs[0].String()
+		}
+	}
+	return ""
+}
+
+// serviceAddr6 is like serviceAddr(), but returns an IPv6 address.
+func serviceAddr6(name string, network string) string {
+	for _, ha := range hostAddrs[name] {
+		if network != "" && ha.Network != network {
+			continue
+		}
+		for _, addr := range ha.Addrs {
+			if addr.Is6() {
+				return addr.String()
+			}
+		}
+	}
+	return ""
+}
+
+// hasFamily returns true if `name` has an IPv6 (if `is6`) or IPv4
+// address on the network `network`.
+func hasFamily(name string, network string, is6 bool) bool {
+	for _, ha := range hostAddrs[name] {
+		if ha.Network != network {
+			continue
+		}
+		for _, addr := range ha.Addrs {
+			if addr.Is6() == is6 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cmdNetwork handles the NETWORK script command, to define a network.
+func cmdNetwork(words []string) error {
+	if len(words) < 2 || len(words) > 3 {
+		return errors.New("expected NETWORK <name> <cidr> [<cidr6>]")
+	}
+
+	var prefixes []netip.Prefix
+	for _, word := range words[1:] {
+		prefix, err := netip.ParsePrefix(word)
+		if err != nil {
+			return err
+		}
+		for _, tn := range testNetworks {
+			if slices.ContainsFunc(tn.prefixes, prefix.Overlaps) {
+				return fmt.Errorf("%v overlaps another network", prefix)
+			}
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return addNetwork(words[0], prefixes)
+}
+
+// addBossHost gives the boss service dedicated addresses on `network`
+// for the client or proxy `name`, and adds them to its /etc/hosts.
+func addBossHost(name string, network string) error {
+	if err := attachNetwork("boss", network); err != nil {
+		return err
+	}
+	addrs, err := testNetworks[network].alloc()
+	if err != nil {
+		return err
+	}
+	hostAddrs[name] = []hostAddr{{network, addrs}}
+
+	bossSvc := compose.Services["boss"]
+	nw := bossSvc.Networks[network]
+	for _, addr := range addrs {
+		extraIP := addr.String()
+		bossSvc.ExtraHosts = append(bossSvc.ExtraHosts, name+":"+extraIP)
+		nw.LinkLocalIPs = append(nw.LinkLocalIPs, extraIP)
+	}
+	return nil
+}
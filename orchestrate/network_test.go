@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+// newTestCompose gives the test an empty Compose application, and
+// restores the old one when the test ends.
+func newTestCompose(t *testing.T) {
+	oldCompose, oldNetworks := compose, testNetworks
+	oldAddrs, oldContainers := hostAddrs, containers
+	oldLinks, oldProxies := linkProxies, serverProxies
+	t.Cleanup(func() {
+		compose, testNetworks = oldCompose, oldNetworks
+		hostAddrs, containers = oldAddrs, oldContainers
+		linkProxies, serverProxies = oldLinks, oldProxies
+	})
+	compose = Compose{
+		Services: make(map[string]*Service),
+		Networks: make(map[string]*Network),
+		Configs:  make(map[string]*ConfigOrSecret),
+	}
+	testNetworks = make(map[string]*testNetwork)
+	hostAddrs = make(map[string][]hostAddr)
+	containers = make(map[string]string)
+	linkProxies, serverProxies = stringSet{}, stringSet{}
+}
+
+// addTestService adds an empty service named `name`.
+func addTestService(name string) {
+	compose.Services[name] = &Service{Networks: make(map[string]*ServiceNetwork)}
+	containers[name] = name
+}
+
+func TestNetworkAlloc(t *testing.T) {
+	newTestCompose(t)
+	if err := cmdNetwork([]string{"inner", "10.1.2.0/29", "fd00:1::/125"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmdNetwork([]string{"outer", "10.1.3.0/30"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		addTestService(name)
+	}
+
+	// Addresses are assigned in order, after the gateway.
+	attach := []struct {
+		svc, network string
+		want         []string
+	}{
+		{"a", "inner", []string{"10.1.2.2", "fd00:1::2"}},
+		{"b", "inner", []string{"10.1.2.3", "fd00:1::3"}},
+		{"a", "inner", []string{"10.1.2.2", "fd00:1::2"}},
+		{"a", "outer", []string{"10.1.3.2"}},
+		{"c", "inner", []string{"10.1.2.4", "fd00:1::4"}},
+		{"d", "inner", []string{"10.1.2.5", "fd00:1::5"}},
+		{"e", "inner", []string{"10.1.2.6", "fd00:1::6"}},
+	}
+	for _, tc := range attach {
+		if err := attachNetwork(tc.svc, tc.network); err != nil {
+			t.Fatalf("attachNetwork(%s, %s) failed: %v", tc.svc, tc.network, err)
+		}
+		got := compose.Services[tc.svc].Networks[tc.network]
+		want := &ServiceNetwork{IPv4Address: tc.want[0]}
+		if len(tc.want) > 1 {
+			want.IPv6Address = tc.want[1]
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s on %s = %+v; want %+v", tc.svc, tc.network, got, want)
+		}
+	}
+
+	if got := networksOf("a"); !reflect.DeepEqual(got, []string{"inner", "outer"}) {
+		t.Errorf("networksOf(a) = %q", got)
+	}
+	if got := serviceAddr("a", ""); got != "10.1.2.2" {
+		t.Errorf("serviceAddr(a) = %q", got)
+	}
+	if got := serviceAddr("a", "outer"); got != "10.1.3.2" {
+		t.Errorf("serviceAddr(a, outer) = %q", got)
+	}
+	if got := serviceAddr6("b", "inner"); got != "fd00:1::3" {
+		t.Errorf("serviceAddr6(b, inner) = %q", got)
+	}
+	if got := serviceAddr6("a", "outer"); got != "" {
+		t.Errorf("serviceAddr6(a, outer) = %q", got)
+	}
+
+	// The /29 has room for six hosts after the gateway; the last one is
+	// the broadcast address, but the engine does not reserve it.
+	addTestService("f")
+	if err := attachNetwork("f", "inner"); err != nil {
+		t.Errorf("attachNetwork(f) failed: %v", err)
+	}
+	addTestService("g")
+	if err := attachNetwork("g", "inner"); err == nil {
+		t.Errorf("attachNetwork(g) succeeded on a full network: %+v",
+			compose.Services["g"].Networks["inner"])
+	}
+	if err := attachNetwork("g", "nowhere"); err == nil {
+		t.Errorf("attachNetwork(g, nowhere) succeeded")
+	}
+}
+
+func TestCmdNetworkErrors(t *testing.T) {
+	newTestCompose(t)
+	if err := cmdNetwork([]string{"inner", "10.1.0.0/16"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, words := range [][]string{
+		{"inner"},
+		{"other", "10.1.2.0/24"},
+		{"other", "10.0.0.0/8"},
+		{"inner", "10.2.0.0/16"},
+		{"other", "fd00::/64", "10.2.0.0/16"},
+		{"other", "10.2.0.0/16", "10.3.0.0/16"},
+		{"other", "10.2.0.0"},
+		{"other", "10.2.0.0/16", "fd00::/64", "fd01::/64"},
+	} {
+		if err := cmdNetwork(words); err == nil {
+			t.Errorf("cmdNetwork(%q) succeeded", words)
+		}
+	}
+	if _, ok := testNetworks["other"]; ok {
+		t.Errorf("a failed NETWORK command defined a network")
+	}
+}
+
+func TestAddBossHost(t *testing.T) {
+	newTestCompose(t)
+	if err := cmdNetwork([]string{"inner", "10.1.2.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	addTestService("boss")
+	for _, name := range []string{"user1", "user2"} {
+		if err := addBossHost(name, "inner"); err != nil {
+			t.Fatalf("addBossHost(%s) failed: %v", name, err)
+		}
+	}
+
+	boss := compose.Services["boss"]
+	wantHosts := []string{"user1:10.1.2.3", "user2:10.1.2.4"}
+	if !reflect.DeepEqual(boss.ExtraHosts, wantHosts) {
+		t.Errorf("ExtraHosts = %q; want %q", boss.ExtraHosts, wantHosts)
+	}
+	nw := boss.Networks["inner"]
+	if nw.IPv4Address != "10.1.2.2" ||
+		!reflect.DeepEqual(nw.LinkLocalIPs, []string{"10.1.2.3", "10.1.2.4"}) {
+		t.Errorf("boss on inner = %+v", nw)
+	}
+	want := []hostAddr{{"inner", []netip.Addr{netip.MustParseAddr("10.1.2.4")}}}
+	if !reflect.DeepEqual(hostAddrs["user2"], want) {
+		t.Errorf("hostAddrs[user2] = %v; want %v", hostAddrs["user2"], want)
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"archive/tar"
 	"bytes"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"flag"
@@ -20,15 +19,17 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 	"text/template"
 
-	"golang.org/x/crypto/pbkdf2"
 	"gopkg.in/yaml.v3"
 )
 
 var networkCIDR = flag.String("cidr", "10.11.12.0/24",
 	"CIDR representation of test network IP address range")
+var networkCIDR6 = flag.String("cidr6", "",
+	"CIDR representation of an IPv6 range to make the test network dual-stack")
 var noGenerate = flag.Bool("q", false,
 	"If set, do not create compose.yaml and related files")
 var noExecute = flag.Bool("n", false,
@@ -41,6 +42,8 @@ var lcovTool = flag.String("lcov", "lcov",
 	"Coverage tool to execute")
 var seedFlag = flag.String("seed", "",
 	"Random seed to use (base64 encoded)")
+var libDir = flag.String("lib", filepath.Join("..", "lib"),
+	"Directory (relative to the script directory) with shared templates and script fragments")
 var failed bool
 var scriptName string
 var seed []byte
@@ -48,12 +51,6 @@ var seed []byte
 const dirMode = os.FileMode(0750)
 const fileMode = os.FileMode(0640)
 
-// netMask is the parsed form of `networkCIDR`.
-var netMask netip.Prefix
-
-// nextAddr is the next address to assign from `netMask`.
-var nextAddr netip.Addr
-
 // compose is the Compose file being constructed.
 var compose Compose
 
@@ -79,11 +76,8 @@ func ircIsSpace(ch byte) bool {
 
 // createBoss creates the "boss" service.
 func createBoss() {
-	// Skip the first address so that Podman can use it for DNS etc.
-	nextAddr = nextAddr.Next()
-
 	// Create the service.
-	if err := makeService("boss", "boss"); err != nil {
+	if err := makeService("boss", "boss", []string{defaultNetwork}); err != nil {
 		log.Fatalf("failed to create boss service: %v", err)
 	}
 
@@ -102,28 +96,28 @@ func createBoss() {
 }
 
 // makeService adds a service named `name` with type `image` to the
-// Compose application.
-func makeService(name string, image string) error {
+// Compose application, attached to `networks`.
+func makeService(name string, image string, networks []string) error {
 	if compose.Services["boss"] == nil && name != "boss" {
 		createBoss()
 	}
 
-	svcNetwork := ServiceNetwork{}
-	if nextAddr.Is4() {
-		svcNetwork.IPv4Address = nextAddr.String()
-	} else {
-		svcNetwork.IPv6Address = nextAddr.String()
+	for _, network := range networks {
+		if testNetworks[network] == nil {
+			return errors.New("no network is named " + network)
+		}
 	}
-	svc := &Service{
-		Image: "localhost/coder-com/" + image,
-		Networks: map[string]*ServiceNetwork{
-			"inner": &svcNetwork,
-		},
+	compose.Services[name] = &Service{
+		Image:      "localhost/coder-com/" + image,
+		Networks:   make(map[string]*ServiceNetwork),
 		PullPolicy: "never",
 	}
-	nextAddr = nextAddr.Next()
-	compose.Services[name] = svc
 	containers[name] = name
+	for _, network := range networks {
+		if err := attachNetwork(name, network); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -178,33 +172,65 @@ func cmdClient(words []string) error {
 		return errors.New("no existing server is named " + server)
 	}
 
+	// Which network and address family should the client use?
+	network, family := "", ""
+	for _, word := range words[2:] {
+		if value, found := strings.CutPrefix(word, "network="); found {
+			network = value
+		}
+		if value, found := strings.CutPrefix(word, "family="); found {
+			family = value
+		}
+	}
+	if runsOn != "" {
+		if network != "" {
+			return errors.New("a client that runs on another cannot choose a network")
+		}
+		network = networksOf(runsOn)[0]
+	} else if network == "" {
+		network = defaultNetwork
+	}
+	if testNetworks[network] == nil {
+		return errors.New("no network is named " + network)
+	}
+	if !slices.Contains(networksOf(server), network) {
+		return fmt.Errorf("%s is not on network %s", server, network)
+	}
+
+	// Check that the client can use the address family it asks for.
+	switch family {
+	case "":
+	case "4", "6":
+		if !hasFamily(server, network, family == "6") {
+			return fmt.Errorf("%s has no IPv%s address on %s", server, family, network)
+		}
+	default:
+		return errors.New("family must be 4 or 6")
+	}
+
 	// Clients run on the boss service.
 	containers[name] = "boss"
 
-	// If this client needs a dedicated IP address, assign one.
-	if runsOn == "" {
-		// Allocate an IP address.
-		extraIP := nextAddr.String()
-		nextAddr = nextAddr.Next()
-
-		// Assign it to the container and ready it for /etc/hosts.
-		bossSvc := compose.Services[containers[name]]
-		bossSvc.ExtraHosts = append(bossSvc.ExtraHosts, name+":"+extraIP)
-		nw := bossSvc.Networks["inner"]
-		nw.LinkLocalIPs = append(nw.LinkLocalIPs, extraIP)
-		bossSvc.Networks["inner"] = nw
+	// If this client needs dedicated IP addresses, assign them.
+	if runsOn != "" {
+		hostAddrs[name] = hostAddrs[runsOn]
+		return nil
 	}
-	return nil
+	return addBossHost(name, network)
 }
 
 // cmdServer creates a new IRC server.
 func cmdServer(words []string) error {
 	// Parse the command line arguments.
-	if len(words) != 2 {
-		return errors.New("expected SERVER <name> <image>")
+	if len(words) < 2 {
+		return errors.New("expected SERVER <name> <image> [<network> ...]")
 	}
 	name := replaceSuffix(words[0])
 	image := words[1]
+	networks := words[2:]
+	if len(networks) == 0 {
+		networks = []string{defaultNetwork}
+	}
 
 	if !strings.ContainsAny(name, ".") {
 		return errors.New("server names must contain a dot")
@@ -213,7 +239,7 @@ func cmdServer(words []string) error {
 		return errors.New("already have something named " + name)
 	}
 
-	return makeService(name, image)
+	return makeService(name, image, networks)
 }
 
 // cmdSuffix adjusts the "standard" suffix for server or host names.
@@ -227,14 +253,80 @@ func cmdSuffix(words []string) error {
 
 // scriptCommands maps a command token to the function that handles it.
 var scriptCommands = map[string]func([]string) error{
-	"CLIENT": cmdClient,
-	"SERVER": cmdServer,
-	"SUFFIX": cmdSuffix,
+	"CLIENT":   cmdClient,
+	"DNS":      cmdDNS,
+	"DNSBL":    cmdDNSBL,
+	"KILL":     cmdContainer("KILL <server> [<signal>]"),
+	"LINK":     cmdLink,
+	"NETWORK":  cmdNetwork,
+	"PROXY":    cmdProxy,
+	"RECONFIG": cmdContainer("RECONFIG <server> <variant>"),
+	"REHASH":   cmdContainer("REHASH <server>"),
+	"RESTART":  cmdContainer("RESTART <server>"),
+	"SERVER":   cmdServer,
+	"START":    cmdContainer("START <server>"),
+	"SUFFIX":   cmdSuffix,
+}
+
+// bossLibDir is where `boss` looks for INCLUDE files.
+const bossLibDir = "/etc/boss/lib"
+
+// cmdInclude processes a script fragment from `libDir`, and makes it
+// available to the boss.
+// `stack` lists the fragments that are already being included.
+func cmdInclude(words []string, stack []string) error {
+	if len(words) != 1 {
+		return errors.New("expected INCLUDE <file>")
+	}
+	name := words[0]
+	if !filepath.IsLocal(name) {
+		return errors.New("invalid INCLUDE file name " + name)
+	}
+	for _, other := range stack {
+		if other == name {
+			return fmt.Errorf("INCLUDE cycle: %s -> %s",
+				strings.Join(stack, " -> "), name)
+		}
+	}
+
+	// Read the fragment.
+	fullPath := filepath.Join(*libDir, name)
+	text, err := os.ReadFile(fullPath)
+	if err != nil {
+		return err
+	}
+
+	// Pass the fragment to the boss, if we have not already.
+	if compose.Services["boss"] == nil {
+		createBoss()
+	}
+	cfgName := "lib-" + strings.ReplaceAll(filepath.ToSlash(name), "/", "_")
+	if _, ok := compose.Configs[cfgName]; !ok {
+		compose.Configs[cfgName] = &ConfigOrSecret{
+			File: fullPath,
+		}
+		boss := compose.Services["boss"]
+		boss.Configs = append(boss.Configs, ServiceConfig{
+			Source: cfgName,
+			Target: bossLibDir + "/" + filepath.ToSlash(name),
+		})
+	}
+
+	doScript(name, string(text), append(stack, name))
+	return nil
+}
+
+// doScript executes each line of `text`, which came from `file`.
+// `stack` lists the fragments that are being included.
+func doScript(file string, text string, stack []string) {
+	for lineno, line := range strings.Split(text, "\n") {
+		doScriptLine(line, file, lineno+1, stack)
+	}
 }
 
 // doScriptLine executes the command in line.  If an error occurs, it
-// reports it with lineno.
-func doScriptLine(line string, lineno int) {
+// reports it with file and lineno.
+func doScriptLine(line string, file string, lineno int, stack []string) {
 	// Trim leading and trailing whitespace.
 	line = strings.Trim(line, "\r\n\t ")
 
@@ -268,10 +360,14 @@ func doScriptLine(line string, lineno int) {
 	}
 
 	// Dispatch the command, ignoring unrecognized commands.
-	if cmd, ok := scriptCommands[parts[0]]; ok {
-		if err := cmd(parts[1:]); err != nil {
-			fmt.Printf("ERROR line %d (%s): %v\n", lineno, parts[0], err)
-		}
+	var err error
+	if parts[0] == "INCLUDE" {
+		err = cmdInclude(parts[1:], stack)
+	} else if cmd, ok := scriptCommands[parts[0]]; ok {
+		err = cmd(parts[1:])
+	}
+	if err != nil {
+		fmt.Printf("ERROR %s:%d (%s): %v\n", file, lineno, parts[0], err)
 	}
 }
 
@@ -289,10 +385,72 @@ type ConfigObject struct {
 	Me       string
 	IP       map[string]string
 	ClientIP map[string]string
+
+	// IP6 and ClientIP6 are like IP and ClientIP, but hold IPv6
+	// addresses, when the network supports IPv6.
+	// (On a dual-stack network, IP and ClientIP hold IPv4 addresses.)
+	IP6       map[string]string
+	ClientIP6 map[string]string
+
+	// NetIP and NetIP6 map network names to maps like IP and IP6 for
+	// that network.
+	// (IP and IP6 give each name's addresses on its first network.)
+	NetIP  map[string]map[string]string
+	NetIP6 map[string]map[string]string
+
+	// CAFile, CertFile and KeyFile are the paths, within a server's
+	// container, of the testnet CA and the server's certificate and key.
+	CAFile   string
+	CertFile string
+	KeyFile  string
+
+	// Fingerprint maps server and client names to the SHA-256
+	// fingerprints of their certificates.
+	Fingerprint map[string]string
+}
+
+// addrMaps builds the address maps for ConfigObject.
+func addrMaps() ConfigObject {
+	obj := ConfigObject{
+		IP:        make(map[string]string),
+		ClientIP:  make(map[string]string),
+		IP6:       make(map[string]string),
+		ClientIP6: make(map[string]string),
+		NetIP:     make(map[string]map[string]string),
+		NetIP6:    make(map[string]map[string]string),
+	}
+	for network := range testNetworks {
+		obj.NetIP[network] = make(map[string]string)
+		obj.NetIP6[network] = make(map[string]string)
+	}
+
+	for name := range hostAddrs {
+		isClient := !strings.ContainsRune(name, '.')
+		if addr := serviceAddr(name, ""); addr != "" {
+			obj.IP[name] = addr
+			if isClient {
+				obj.ClientIP[name] = addr
+			}
+		}
+		if addr := serviceAddr6(name, ""); addr != "" {
+			obj.IP6[name] = addr
+			if isClient {
+				obj.ClientIP6[name] = addr
+			}
+		}
+		for _, network := range networksOf(name) {
+			obj.NetIP[network][name] = serviceAddr(name, network)
+			if addr := serviceAddr6(name, network); addr != "" {
+				obj.NetIP6[network][name] = addr
+			}
+		}
+	}
+	return obj
 }
 
 // writeConfig writes the config file for `name`.
-func writeConfig(tmpl *template.Template, ips map[string]string) {
+// `addrs` holds the address maps to pass to the template.
+func writeConfig(tmpl *template.Template, addrs ConfigObject) {
 	// Does this look like <host>:<file> for a known container host?
 	host, file, found := strings.Cut(tmpl.Name(), ":")
 	if !found {
@@ -304,33 +462,36 @@ func writeConfig(tmpl *template.Template, ips map[string]string) {
 		return
 	}
 
+	// Is this a variant of the file, for RECONFIG to switch to?
+	file, variant, isVariant := strings.Cut(file, "@")
+	if isVariant && !validVariant(variant) {
+		log.Fatalf("invalid config variant name in %s", tmpl.Name())
+	}
+
 	// Can we create the directory the file exists in?
 	fullPath := filepath.Join(host, file)
+	if isVariant {
+		fullPath += "@" + variant
+	}
 	dirPath := filepath.Dir(fullPath)
 	if err := os.MkdirAll(dirPath, dirMode); err != nil {
 		log.Println(err)
 		return
 	}
 
-	// Build a subset of the IP mappings for clients.
-	clientIP := make(map[string]string)
-	for k, v := range ips {
-		if !strings.ContainsRune(k, '.') {
-			clientIP[k] = v
-		}
-	}
-
 	// Create the file and execute the template.
 	f, err := os.Create(fullPath)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	if err = tmpl.Execute(f, &ConfigObject{
-		Me:       host,
-		IP:       ips,
-		ClientIP: clientIP,
-	}); err != nil {
+	obj := addrs
+	obj.Me = host
+	obj.CAFile = serverTLSDir + "/ca.pem"
+	obj.CertFile = serverTLSDir + "/cert.pem"
+	obj.KeyFile = serverTLSDir + "/key.pem"
+	obj.Fingerprint = fingerprints()
+	if err = tmpl.Execute(f, &obj); err != nil {
 		log.Fatal(err)
 	}
 	if err = f.Close(); err != nil {
@@ -338,6 +499,10 @@ func writeConfig(tmpl *template.Template, ips map[string]string) {
 	}
 
 	// Stash this as a configuration.
+	if isVariant {
+		addVariant(host, file, fullPath)
+		return
+	}
 	cfgName := strings.ReplaceAll(tmpl.Name(), "/", "_")
 	cfgName = strings.ReplaceAll(cfgName, ":", "-")
 	compose.Configs[cfgName] = &ConfigOrSecret{
@@ -354,31 +519,63 @@ func writeConfig(tmpl *template.Template, ips map[string]string) {
 // global key plus the salt (which is often an ASCII string).
 // It returns a 16-character base64 string (with 96 bits of entropy).
 func makePassword(salt string) string {
-	pw := pbkdf2.Key(seed, []byte(salt), 4096, 12, sha256.New)
-	return base64.RawURLEncoding.EncodeToString(pw)
+	return base64.RawURLEncoding.EncodeToString(deriveBytes(salt, 12))
+}
+
+// composeProject returns the Compose project name for the script.
+func composeProject() string {
+	if *projectFlag != "" {
+		return *projectFlag
+	}
+	return scriptName
 }
 
 func setup() {
 	compose = Compose{
-		Name:     scriptName,
+		Name:     composeProject(),
 		Services: make(map[string]*Service),
 		Networks: make(map[string]*Network),
 		Configs:  make(map[string]*ConfigOrSecret),
 	}
 
-	// Parse command-line flags.
+	// Parse command-line flags, and create the default network.
 	var err error
-	if netMask, err = netip.ParsePrefix(*networkCIDR); err != nil {
-		log.Fatalf("%s not parsed as a network prefix: %v", *networkCIDR, err)
+	var prefixes []netip.Prefix
+	for _, cidr := range []string{*networkCIDR, *networkCIDR6} {
+		if cidr == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			log.Fatalf("%s not parsed as a network prefix: %v", cidr, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	if err = addNetwork(defaultNetwork, prefixes); err != nil {
+		log.Fatalf("invalid -cidr or -cidr6: %v", err)
 	}
-	netMask = netMask.Masked()
-	nextAddr = netMask.Addr().Next() // first address is for the network
 
-	// Parse the script file.
+	// Parse the shared template libraries, then the script file, so the
+	// script can use (or redefine) templates from the libraries.
 	tmpl = template.New("irc.tmpl")
 	tmpl.Funcs(map[string]any{
-		"password": makePassword,
+		"password":        makePassword,
+		"tlsCert":         tmplTLSCert,
+		"tlsKey":          tmplTLSKey,
+		"certFingerprint": tmplCertFingerprint,
+		"sshKey":          tmplSSHKey,
+		"sshPublicKey":    tmplSSHPublicKey,
+		"link":            tmplLink,
 	})
+	libs, err := filepath.Glob(filepath.Join(*libDir, "*.tmpl"))
+	if err != nil {
+		log.Fatalf("failed to list template libraries: %v", err)
+	}
+	if len(libs) > 0 {
+		if tmpl, err = tmpl.ParseFiles(libs...); err != nil {
+			log.Fatalf("failed to parse template libraries: %v", err)
+		}
+	}
 	tmpl, err = tmpl.ParseFiles("irc.tmpl")
 	if err != nil {
 		log.Fatalf("failed to parse irc.tmpl as a template file: %v", err)
@@ -395,17 +592,6 @@ func setup() {
 
 	// Populate helper data structures.
 	populateHelpers()
-	compose.Networks["inner"] = &Network{
-		Attachable: false,
-		EnableIPv6: netMask.Addr().Is6(),
-		Internal:   true,
-		IPAM: IPAM{
-			Driver: "default",
-			Config: []IPAMConfig{{
-				Subnet: netMask,
-			}},
-		},
-	}
 
 	// Create a config for the master script.
 	compose.Configs["irc.script"] = &ConfigOrSecret{
@@ -413,27 +599,20 @@ func setup() {
 	}
 
 	// Split the script text into lines and process each.
-	for lineno, line := range strings.Split(scriptText, "\n") {
-		doScriptLine(line, lineno+1)
-	}
-
-	// Map service names to their IP address.
-	ips := make(map[string]string)
-	for k, v := range containers {
-		if k == v {
-			svcNetwork := compose.Services[k].Networks["inner"]
-			addr := svcNetwork.IPv4Address
-			if addr == "" {
-				addr = svcNetwork.IPv6Address
-			}
-			ips[k] = addr
-		}
+	doScript("irc.script", scriptText, nil)
+
+	// Make boss the DNS server, if the script uses it.
+	if dnsEnabled {
+		setupDNS()
 	}
 
-	// Write the config files.
+	// Create the certificates, then write the config files.
+	writeCerts()
+	addrs := addrMaps()
 	for _, t := range tmpl.Templates() {
-		writeConfig(t, ips)
+		writeConfig(t, addrs)
 	}
+	finishVariants()
 
 	// Write out the Compose file.
 	var composeText []byte
@@ -647,6 +826,44 @@ func collectHeader(hdr *tar.Header, tr *tar.Reader, done stringSet) stringSet {
 	return done
 }
 
+// If `hdr` is a boss report file, copies it next to the coverage data.
+// Returns true if `hdr` was a report file.
+func collectReport(hdr *tar.Header, tr *tar.Reader) bool {
+	// Is it a file in the boss report directory?
+	const prefix = "var/log/boss/"
+	if !strings.HasPrefix(hdr.Name, prefix) || hdr.Typeflag != tar.TypeReg {
+		return false
+	}
+	// Client transcripts are in a subdirectory.
+	name := hdr.Name[len(prefix):]
+	base := strings.TrimPrefix(name, "transcripts/")
+	if base == "" || strings.ContainsRune(base, '/') {
+		return false
+	}
+
+	// Make sure the destination directory exists.
+	reportFile := filepath.Join("..", "..", "coverage", "reports", scriptName, name)
+	reportDir := filepath.Dir(reportFile)
+	if err := os.MkdirAll(reportDir, dirMode); err != nil && !os.IsExist(err) {
+		log.Fatalf("MkdirAll %s: %v", reportDir, err)
+	}
+
+	// Copy the file to the host directory.
+	out, err := os.Create(reportFile)
+	if err != nil {
+		log.Fatalf("error creating %s: %v", reportFile, err)
+	}
+	if _, err = io.Copy(out, tr); err != nil {
+		log.Fatalf("error copying %s: %v", reportFile, err)
+	}
+	if err = out.Close(); err != nil {
+		log.Println(err)
+	}
+	log.Printf("collected %s", reportFile)
+
+	return true
+}
+
 // Collects output from the container with the specified ID.
 func collectOutput(id string) {
 	// `done` names the gcda directories we have created.
@@ -674,7 +891,9 @@ func collectOutput(id string) {
 			log.Fatalf("error reading from %s: %v", id, err)
 		}
 
-		done = collectHeader(hdr, tr, done)
+		if !collectReport(hdr, tr) {
+			done = collectHeader(hdr, tr, done)
+		}
 	}
 
 	// For each GCDA directory we processed, save its data and remove
@@ -710,11 +929,10 @@ func execute() {
 
 // collect collects profile output from all containers for our test script.
 func collect() {
-	prefix := filepath.Base(flag.Arg(0)) + "-"
-	for id, name := range execToolMap("ps", "-a", "--format", "{{.ID}} {{.Names}}") {
-		if strings.HasPrefix(name, prefix) {
-			collectOutput(id)
-		}
+	defer lockCoverage()()
+	label := "label=com.docker.compose.project=" + composeProject()
+	for id := range execToolMap("ps", "-a", "--filter", label, "--format", "{{.ID}} {{.Names}}") {
+		collectOutput(id)
 	}
 }
 
@@ -740,6 +958,18 @@ func main() {
 		}
 	}
 
+	// Should we run every scenario?
+	if *runAllFlag {
+		root := flag.Arg(0)
+		if root == "" {
+			root = "tests"
+		}
+		if !runAll(root) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Switch to the script directory.
 	scriptDir := flag.Arg(0)
 	if scriptDir == "" {
@@ -752,6 +982,7 @@ func main() {
 
 	// Should we collect profiling outputs?
 	if len(collectFiles) > 0 {
+		defer lockCoverage()()
 		for _, id := range collectFiles {
 			collectOutput(id)
 		}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// faultControlPort is the port that fault proxies accept control
+// connections on.  This must match boss's faultControlPort.
+const faultControlPort = "7000"
+
+// serverProxies holds the names of the fault proxies that PROXY
+// commands create.  They pass TLS through to the server, so they need
+// no certificate of their own.
+var serverProxies = stringSet{}
+
+// cmdProxy handles the PROXY script command, which puts a fault proxy
+// in front of ports on a server.
+func cmdProxy(words []string) error {
+	if len(words) < 3 {
+		return errors.New("expected PROXY <name> <server> <port> [<port> ...]")
+	}
+	name := replaceSuffix(words[0])
+	server := replaceSuffix(words[1])
+	ports := words[2:]
+
+	if !strings.ContainsAny(name, ".") {
+		return errors.New("proxy names must contain a dot")
+	}
+	if _, ok := containers[name]; ok {
+		return errors.New("already have something named " + name)
+	}
+	if _, ok := containers[server]; !ok || !strings.ContainsAny(server, ".") {
+		return errors.New("no existing server is named " + server)
+	}
+	for _, port := range ports {
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return errors.New("invalid port " + port)
+		}
+		if port == faultControlPort {
+			return errors.New("port " + port + " is the proxy's control port")
+		}
+	}
+
+	// The proxy joins the server's networks, so clients can use it in
+	// place of the server, and boss must be able to reach its control
+	// port.
+	networks := networksOf(server)
+	if err := makeService(name, "faultproxy", networks); err != nil {
+		return err
+	}
+	svc := compose.Services[name]
+	svc.Build = "../../images/faultproxy"
+	svc.Command = append([]string{"-control", faultControlPort, server}, ports...)
+	serverProxies[name] = struct{}{}
+	return attachNetwork("boss", networks[0])
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/bits"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+var runAllFlag = flag.Bool("all", false,
+	"If set, run every scenario in the given directory (default tests)")
+var jobsFlag = flag.Int("j", 2,
+	"Number of scenarios to run concurrently with -all")
+var poolCIDR = flag.String("pool", "10.11.0.0/16",
+	"CIDR range to divide between scenarios with -all; each gets a range as large as -cidr")
+var poolCIDR6 = flag.String("pool6", "fd00:11::/48",
+	"IPv6 range to divide between scenarios with -all and -cidr6; each gets a range as large as -cidr6")
+var projectFlag = flag.String("project", "",
+	"Compose project name (default is the script directory's name)")
+
+// runnerFlags lists flags that the runner sets for each scenario, rather
+// than passing through from its own command line.
+var runnerFlags = map[string]bool{
+	"all":     true,
+	"cidr":    true,
+	"cidr6":   true,
+	"collect": true,
+	"j":       true,
+	"pool":    true,
+	"pool6":   true,
+	"project": true,
+	"seed":    true,
+}
+
+// scenario describes one test scenario being run by runAll().
+type scenario struct {
+	// Name is the name of the scenario's directory.
+	Name string
+
+	// Dir is the path to the scenario's directory.
+	Dir string
+
+	// CIDR is the network range assigned to the scenario.
+	CIDR netip.Prefix
+
+	// CIDR6 is the IPv6 range assigned to the scenario, if the
+	// scenarios use dual-stack networks.
+	CIDR6 netip.Prefix
+
+	// Err is set if `orchestrate` failed for the scenario.
+	Err error
+
+	// Duration is how long the scenario took to run.
+	Duration time.Duration
+
+	// Summary is the scenario's report summary, if it was collected.
+	Summary *reportSummary
+}
+
+// reportSummary holds the parts of boss's summary.json that we use.
+type reportSummary struct {
+	Passed  bool              `json:"passed"`
+	Counts  map[string]int    `json:"counts"`
+	Results []json.RawMessage `json:"results"`
+}
+
+// Result describes the outcome of the scenario for the summary table.
+func (sc *scenario) Result() string {
+	switch {
+	case sc.Err != nil:
+		return "error"
+	case sc.Summary == nil:
+		return "no report"
+	case sc.Summary.Passed:
+		return "pass"
+	default:
+		return "FAIL"
+	}
+}
+
+// Failed returns true if the scenario did not pass.
+func (sc *scenario) Failed() bool {
+	return sc.Result() != "pass"
+}
+
+// projectName converts `name` into a valid Compose project name.
+func projectName(name string) string {
+	return strings.Map(func(ch rune) rune {
+		switch {
+		case 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9', ch == '_', ch == '-':
+			return ch
+		case 'A' <= ch && ch <= 'Z':
+			return ch - 'A' + 'a'
+		}
+		return '-'
+	}, name)
+}
+
+// nthSubnet returns the `n`th prefix of length `length` within `pool`.
+func nthSubnet(pool netip.Prefix, length int, n int) (netip.Prefix, error) {
+	addr := pool.Masked().Addr()
+	if length < pool.Bits() || length > addr.BitLen() {
+		return netip.Prefix{}, fmt.Errorf("cannot divide %v into /%d ranges", pool, length)
+	}
+
+	// Add n << (BitLen - length) to the address as a 128-bit number.
+	raw := addr.As16()
+	hi := binary.BigEndian.Uint64(raw[:8])
+	lo := binary.BigEndian.Uint64(raw[8:])
+	shift := uint(addr.BitLen() - length)
+	addHi, addLo := uint64(0), uint64(n)<<shift
+	if shift >= 64 {
+		addHi, addLo = uint64(n)<<(shift-64), 0
+	} else if shift > 0 {
+		addHi = uint64(n) >> (64 - shift)
+	}
+	lo, carry := bits.Add64(lo, addLo, 0)
+	hi, _ = bits.Add64(hi, addHi, carry)
+	binary.BigEndian.PutUint64(raw[:8], hi)
+	binary.BigEndian.PutUint64(raw[8:], lo)
+
+	next := netip.AddrFrom16(raw)
+	if addr.Is4() {
+		next = next.Unmap()
+	}
+	if !pool.Contains(next) {
+		return netip.Prefix{}, fmt.Errorf("%v has fewer than %d /%d ranges", pool, n+1, length)
+	}
+	return netip.PrefixFrom(next, length), nil
+}
+
+// findScenarios lists the scenario directories under `root`: those that
+// contain an irc.tmpl file.
+func findScenarios(root string) ([]*scenario, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var scenarios []*scenario
+	for _, entry := range entries {
+		dir := filepath.Join(root, entry.Name())
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, "irc.tmpl")); err != nil {
+			continue
+		}
+		scenarios = append(scenarios, &scenario{Name: entry.Name(), Dir: dir})
+	}
+	sort.Slice(scenarios, func(i, j int) bool {
+		return scenarios[i].Name < scenarios[j].Name
+	})
+	return scenarios, nil
+}
+
+// run runs `orchestrate` for the scenario as a child process, with its
+// output going to orchestrate.log in the scenario directory, and then
+// reads the scenario's report.
+func (sc *scenario) run(self string, args []string) {
+	// Remove any stale report.
+	reportFile := filepath.Join(sc.Dir, "..", "..", "coverage", "reports",
+		sc.Name, "summary.json")
+	if err := os.Remove(reportFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		sc.Err = err
+		return
+	}
+
+	logName := filepath.Join(sc.Dir, "orchestrate.log")
+	logFile, err := os.Create(logName)
+	if err != nil {
+		sc.Err = err
+		return
+	}
+	defer logFile.Close()
+
+	// Run the scenario.
+	if sc.CIDR6.IsValid() {
+		args = append(args, "-cidr6", sc.CIDR6.String())
+	}
+	args = append(args,
+		"-cidr", sc.CIDR.String(),
+		"-project", projectName(sc.Name),
+		"-seed", base64.RawURLEncoding.EncodeToString(seed),
+		sc.Dir)
+	cmd := exec.Command(self, args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	start := time.Now()
+	err = cmd.Run()
+	sc.Duration = time.Since(start)
+	if err != nil {
+		sc.Err = fmt.Errorf("%v (see %s)", err, logName)
+		return
+	}
+
+	// Read the report, if one was collected.
+	text, err := os.ReadFile(reportFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err == nil {
+		sc.Summary = &reportSummary{}
+		err = json.Unmarshal(text, sc.Summary)
+	}
+	if err != nil {
+		sc.Summary = nil
+		sc.Err = err
+	}
+}
+
+// printTable prints the results of running `scenarios`.
+func printTable(scenarios []*scenario) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCENARIO\tCIDR\tRESULT\tCHECKS\tFAILED\tTIME")
+	for _, sc := range scenarios {
+		checks, failed := "-", "-"
+		if sc.Summary != nil {
+			nFailed := 0
+			for outcome, count := range sc.Summary.Counts {
+				if outcome != "matched" && outcome != "absent" {
+					nFailed += count
+				}
+			}
+			checks = fmt.Sprint(len(sc.Summary.Results))
+			failed = fmt.Sprint(nFailed)
+		}
+		cidr := sc.CIDR.String()
+		if sc.CIDR6.IsValid() {
+			cidr += "," + sc.CIDR6.String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%.1fs\n", sc.Name, cidr,
+			sc.Result(), checks, failed, sc.Duration.Seconds())
+	}
+	_ = tw.Flush()
+
+	for _, sc := range scenarios {
+		if sc.Err != nil {
+			fmt.Printf("%s: %v\n", sc.Name, sc.Err)
+		}
+	}
+}
+
+// runAll runs every scenario under `root`, up to `-j` at a time, and
+// prints a table of their results.
+// Returns true if every scenario passed.
+func runAll(root string) bool {
+	scenarios, err := findScenarios(root)
+	if err != nil {
+		log.Fatalf("finding scenarios in %s: %v", root, err)
+	}
+	if len(scenarios) == 0 {
+		log.Fatalf("no scenarios (directories with irc.tmpl) in %s", root)
+	}
+
+	// Give each scenario its own address range.
+	pool, err := netip.ParsePrefix(*poolCIDR)
+	if err != nil {
+		log.Fatalf("%s not parsed as a network prefix: %v", *poolCIDR, err)
+	}
+	size, err := netip.ParsePrefix(*networkCIDR)
+	if err != nil {
+		log.Fatalf("%s not parsed as a network prefix: %v", *networkCIDR, err)
+	}
+	for ii, sc := range scenarios {
+		if sc.CIDR, err = nthSubnet(pool, size.Bits(), ii); err != nil {
+			log.Fatalf("assigning a range to %s: %v", sc.Name, err)
+		}
+	}
+	if *networkCIDR6 != "" {
+		pool6, err := netip.ParsePrefix(*poolCIDR6)
+		if err != nil {
+			log.Fatalf("%s not parsed as a network prefix: %v", *poolCIDR6, err)
+		}
+		size6, err := netip.ParsePrefix(*networkCIDR6)
+		if err != nil {
+			log.Fatalf("%s not parsed as a network prefix: %v", *networkCIDR6, err)
+		}
+		for ii, sc := range scenarios {
+			if sc.CIDR6, err = nthSubnet(pool6, size6.Bits(), ii); err != nil {
+				log.Fatalf("assigning an IPv6 range to %s: %v", sc.Name, err)
+			}
+		}
+	}
+
+	// Pass through the flags that apply to each scenario.
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatalf("finding orchestrate executable: %v", err)
+	}
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		if !runnerFlags[f.Name] {
+			args = append(args, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+
+	// Run the scenarios.
+	jobs := make(chan *scenario)
+	var wg sync.WaitGroup
+	for range max(*jobsFlag, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sc := range jobs {
+				log.Printf("starting %s on %v", sc.Name, sc.CIDR)
+				sc.run(self, args)
+				log.Printf("finished %s: %s", sc.Name, sc.Result())
+			}
+		}()
+	}
+	for _, sc := range scenarios {
+		jobs <- sc
+	}
+	close(jobs)
+	wg.Wait()
+
+	printTable(scenarios)
+	for _, sc := range scenarios {
+		if sc.Failed() {
+			return false
+		}
+	}
+	return true
+}
+
+// lockCoverage waits for exclusive use of the coverage directory, so
+// that concurrent scenarios do not collect coverage data at the same
+// time.
+// It returns a function that releases the lock.
+func lockCoverage() func() {
+	lockName := filepath.Join("..", "..", "coverage", ".lock")
+	f, err := os.OpenFile(lockName, os.O_CREATE|os.O_RDWR, fileMode)
+	if err != nil {
+		log.Fatalf("opening %s: %v", lockName, err)
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		log.Fatalf("locking %s: %v", lockName, err)
+	}
+	return func() {
+		_ = f.Close()
+	}
+}
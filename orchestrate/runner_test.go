@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestNthSubnet(t *testing.T) {
+	tests := []struct {
+		pool   string
+		length int
+		n      int
+		want   string
+	}{
+		{"10.0.0.0/8", 24, 0, "10.0.0.0/24"},
+		{"10.0.0.0/8", 24, 1, "10.0.1.0/24"},
+		{"10.0.0.0/8", 24, 256, "10.1.0.0/24"},
+		{"10.0.0.0/8", 24, 65535, "10.255.255.0/24"},
+		{"10.0.0.0/8", 24, 65536, ""},
+		{"10.1.2.3/16", 16, 0, "10.1.0.0/16"},
+		{"10.1.0.0/16", 16, 1, ""},
+		{"10.1.0.0/16", 32, 65535, "10.1.255.255/32"},
+		{"10.1.0.0/16", 8, 0, ""},
+		{"10.1.0.0/16", 33, 0, ""},
+		{"255.255.255.0/24", 28, 15, "255.255.255.240/28"},
+		{"255.255.255.0/24", 28, 16, ""},
+		{"fd00::/48", 64, 0, "fd00::/64"},
+		{"fd00::/48", 64, 1, "fd00:0:0:1::/64"},
+		{"fd00::/48", 64, 65535, "fd00:0:0:ffff::/64"},
+		{"fd00::/48", 64, 65536, ""},
+		{"fd00::/56", 120, 257, "fd00::1:100/120"},
+		{"fd00::/32", 48, 65535, "fd00:0:ffff::/48"},
+		{"fd00::/64", 128, 3, "fd00::3/128"},
+		{"fd00::/64", 129, 0, ""},
+		{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ff00/120", 124, 15,
+			"ffff:ffff:ffff:ffff:ffff:ffff:ffff:fff0/124"},
+		{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ff00/120", 124, 16, ""},
+		{"ffff:ffff:ffff:ffff::/64", 64, 1, ""},
+	}
+	for _, tc := range tests {
+		pool := netip.MustParsePrefix(tc.pool)
+		got, err := nthSubnet(pool, tc.length, tc.n)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("nthSubnet(%s, %d, %d) = %v; want error", tc.pool, tc.length, tc.n, got)
+			}
+		} else if err != nil || got != netip.MustParsePrefix(tc.want) {
+			t.Errorf("nthSubnet(%s, %d, %d) = %v, %v; want %s",
+				tc.pool, tc.length, tc.n, got, err, tc.want)
+		}
+	}
+}
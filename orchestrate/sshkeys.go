@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"path/filepath"
+)
+
+// sshDir is the directory (within the script directory) where we write
+// SSH keys.
+const sshDir = "ssh"
+
+// serverSSHDir is where containers find their SSH keys.
+const serverSSHDir = "/etc/testnet/ssh"
+
+// sshKeyFor derives the SSH key for `name`.
+func sshKeyFor(name string) ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(deriveBytes("ssh key "+name, ed25519.SeedSize))
+}
+
+// appendSSHString appends `s` to `buf` as an SSH wire-format string.
+func appendSSHString(buf []byte, s []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+// sshPublicBlob returns the SSH wire format of the public half of `key`.
+func sshPublicBlob(key ed25519.PrivateKey) []byte {
+	blob := appendSSHString(nil, []byte("ssh-ed25519"))
+	return appendSSHString(blob, key.Public().(ed25519.PublicKey))
+}
+
+// sshPrivatePEM formats `key` in the OpenSSH private key format.
+// OpenSSH uses a random "check" value to detect a wrong passphrase; we
+// derive it from the key, since the key is not encrypted, so that the
+// output is reproducible.
+func sshPrivatePEM(key ed25519.PrivateKey, comment string) []byte {
+	check := binary.BigEndian.Uint32(key.Seed())
+
+	// Build the private section, padded to the cipher block size (8).
+	priv := binary.BigEndian.AppendUint32(nil, check)
+	priv = binary.BigEndian.AppendUint32(priv, check)
+	priv = appendSSHString(priv, []byte("ssh-ed25519"))
+	priv = appendSSHString(priv, key.Public().(ed25519.PublicKey))
+	priv = appendSSHString(priv, key)
+	priv = appendSSHString(priv, []byte(comment))
+	for pad := byte(1); len(priv)%8 != 0; pad++ {
+		priv = append(priv, pad)
+	}
+
+	// Build the whole key.
+	data := append([]byte("openssh-key-v1"), 0)
+	data = appendSSHString(data, []byte("none")) // cipher
+	data = appendSSHString(data, []byte("none")) // KDF
+	data = appendSSHString(data, nil)            // KDF options
+	data = binary.BigEndian.AppendUint32(data, 1)
+	data = appendSSHString(data, sshPublicBlob(key))
+	data = appendSSHString(data, priv)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: data})
+}
+
+// tmplSSHKey implements the `sshKey` template function.
+// `{{ sshKey <host> [<name>] }}` passes the SSH private key for `<name>`
+// (or `<host>`) to `<host>`, and gives its path there.
+func tmplSSHKey(host string, names ...string) (string, error) {
+	host, name, err := templateHost(host, names)
+	if err != nil {
+		return "", err
+	}
+	target := serverSSHDir + "/" + name
+	addFileConfig(host, filepath.Join(sshDir, name),
+		sshPrivatePEM(sshKeyFor(name), name), target)
+	return target, nil
+}
+
+// tmplSSHPublicKey implements the `sshPublicKey` template function.
+// `{{ sshPublicKey <name> }}` gives the SSH public key for `<name>`, as
+// a line for an authorized_keys file.
+func tmplSSHPublicKey(name string) string {
+	name = replaceSuffix(name)
+	blob := sshPublicBlob(sshKeyFor(name))
+	return "ssh-ed25519 " + base64.StdEncoding.EncodeToString(blob) + " " + name
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// bossConfigDir is where boss finds servers' config files that have
+// variants, and the variants themselves.
+const bossConfigDir = "/etc/boss/configs"
+
+// defaultVariant names the copy of a config file as it was first
+// written, so RECONFIG can switch back to it.
+const defaultVariant = "default"
+
+// configVariants holds the paths of config files on the host (as
+// "<host><file>") that have variants.
+var configVariants = stringSet{}
+
+// validVariant returns true if `variant` can name a config variant.
+func validVariant(variant string) bool {
+	return variant != "" && variant != defaultVariant &&
+		!strings.ContainsAny(variant, "/@")
+}
+
+// addVariant passes `fullPath`, a variant of the config file `file` for
+// `host`, to boss.
+func addVariant(host, file, fullPath string) {
+	configVariants[host+file] = struct{}{}
+	addBossConfig(fullPath)
+}
+
+// addBossConfig passes the file `hostPath` to boss, at the same path
+// under bossConfigDir.
+func addBossConfig(hostPath string) {
+	cfgName := "variant-" + strings.NewReplacer("/", "_", "@", "-").Replace(hostPath)
+	compose.Configs[cfgName] = &ConfigOrSecret{
+		File: hostPath,
+	}
+	boss := compose.Services["boss"]
+	boss.Configs = append(boss.Configs, ServiceConfig{
+		Source: cfgName,
+		Target: path.Join(bossConfigDir, hostPath),
+	})
+}
+
+// finishVariants lets boss replace each config file that has variants,
+// and saves a copy of the file as the default variant.
+//
+// RECONFIG depends on how the file is shared: the server gets it as a
+// Compose config, which the engine bind-mounts from the host file, and
+// boss gets a writable bind mount of the same host file, which it
+// rewrites in place.  So the file must stay a host file (not be copied
+// into an image), and nothing may replace it by renaming another file
+// over it, or the server would keep seeing the old file.
+func finishVariants() {
+	bases := make([]string, 0, len(configVariants))
+	for base := range configVariants {
+		bases = append(bases, base)
+	}
+	sort.Strings(bases)
+
+	boss := compose.Services["boss"]
+	for _, base := range bases {
+		data, err := os.ReadFile(base)
+		if err != nil {
+			log.Fatalf("config variants need a base config: %v", err)
+		}
+		defaultPath := base + "@" + defaultVariant
+		if err = os.WriteFile(defaultPath, data, fileMode); err != nil {
+			log.Fatalf("failed to write %s: %v", defaultPath, err)
+		}
+		addBossConfig(defaultPath)
+		boss.Volumes = append(boss.Volumes, "./"+base+":"+path.Join(bossConfigDir, base))
+	}
+}